@@ -7,3 +7,23 @@ replace github.com/gptlocal/netool/z => ../z
 replace github.com/gptlocal/netool/w => ../w
 
 require github.com/gptlocal/netool/w v0.0.0-00010101000000-000000000000
+
+require golang.org/x/crypto v0.32.0
+
+require (
+	github.com/gptlocal/netool/z v0.0.0-00010101000000-000000000000
+	go.uber.org/zap v1.26.0
+	golang.org/x/net v0.34.0
+	golang.org/x/time v0.4.0
+	google.golang.org/grpc v1.59.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ConnectDialer connects to the targets through an upstream HTTP proxy with CONNECT requests.
+type ConnectDialer struct {
+	// ProxyURL is the http:// or https:// URL of the proxy, its userinfo is sent as the
+	// basic credentials of the Proxy-Authorization header.
+	ProxyURL *url.URL
+
+	// Dialer connects to the proxy. If nil, a zero net.Dialer is used.
+	Dialer Dialer
+
+	// TLSConfig configures the TLS connection to an https:// proxy.
+	TLSConfig *tls.Config
+}
+
+// DialContext connects to address through the proxy, the context covers both connecting
+// to the proxy and the CONNECT request.
+func (d *ConnectDialer) DialContext(ctx context.Context, network, address string) (_ net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	u := d.ProxyURL
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var dialer Dialer = &net.Dialer{}
+	if d.Dialer != nil {
+		dialer = d.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	switch u.Scheme {
+	case "http":
+	case "https":
+		config := d.TLSConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, config)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tc
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", u.Scheme)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() {
+			err = ctx.Err()
+		}
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password)))
+	}
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy: CONNECT %s: %s", address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, br: br}, nil
+	}
+	return conn, nil
+}
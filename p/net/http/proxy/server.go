@@ -0,0 +1,223 @@
+// Package proxy implements an HTTP proxy server: CONNECT tunnels and forwarding of
+// absolute-URI requests for plain HTTP, optionally through an upstream relay or proxy.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/relay"
+)
+
+// Dialer connects to the targets of the proxy, *relay.Client and *ConnectDialer satisfy this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Server is an HTTP proxy, it serves the CONNECT requests by tunnelling the connection to the
+// requested host and forwards the requests for absolute http:// URIs.
+type Server struct {
+	// Addr is the TCP address to listen on, used by ListenAndServe.
+	Addr string
+
+	// Dialer connects to the targets. If nil, a zero net.Dialer is used.
+	Dialer Dialer
+
+	// Authenticator, if not nil, requires the basic credentials of the Proxy-Authorization header.
+	Authenticator relay.Authenticator
+
+	// Realm is the realm of the Proxy-Authenticate challenge, "proxy" if empty.
+	Realm string
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+func (s *Server) ListenAndServe() error {
+	return (&http.Server{Addr: s.Addr, Handler: s}).ListenAndServe()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Authenticator != nil && !s.authenticate(r) {
+		realm := s.Realm
+		if realm == "" {
+			realm = "proxy"
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		s.handleConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "proxy: absolute http:// URI required", http.StatusBadRequest)
+		return
+	}
+	s.handleForward(w, r)
+}
+
+func (s *Server) authenticate(r *http.Request) bool {
+	auth := r.Header.Get("Proxy-Authorization")
+	scheme, credentials, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	return ok && s.Authenticator.Authenticate(r.Context(), username, password)
+}
+
+// handleConnect tunnels the connection of r to the requested host.
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 1 {
+		http.Error(w, "proxy: CONNECT requires HTTP/1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	cc, err := s.dialer().DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		log.Printf("proxy: %s: connect %s: %v", r.RemoteAddr, r.Host, err)
+		http.Error(w, http.StatusText(statusFromError(err)), statusFromError(err))
+		return
+	}
+	defer cc.Close()
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("proxy: %s: hijack: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Printf("proxy: %s: write response: %v", r.RemoteAddr, err)
+		return
+	}
+
+	var rw io.ReadWriter = conn
+	if brw.Reader.Buffered() > 0 {
+		// The client sent data after the request without waiting for the response.
+		rw = &bufferedConn{Conn: conn, br: brw.Reader}
+	}
+	if err := netutil.Transport(rw, cc); err != nil {
+		log.Printf("proxy: %s <-> %s: %v", r.RemoteAddr, r.Host, err)
+	}
+}
+
+// handleForward sends r to the origin server and copies the response.
+func (s *Server) handleForward(w http.ResponseWriter, r *http.Request) {
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	outreq.Close = false
+	removeHopByHopHeaders(outreq.Header)
+	if r.ContentLength == 0 {
+		outreq.Body = nil
+	}
+
+	resp, err := s.roundTripper().RoundTrip(outreq)
+	if err != nil {
+		log.Printf("proxy: %s: %s %s: %v", r.RemoteAddr, r.Method, r.URL, err)
+		http.Error(w, http.StatusText(statusFromError(err)), statusFromError(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("proxy: %s: copy response of %s: %v", r.RemoteAddr, r.URL, err)
+	}
+}
+
+func (s *Server) dialer() Dialer {
+	if s.Dialer != nil {
+		return s.Dialer
+	}
+	return &net.Dialer{}
+}
+
+func (s *Server) roundTripper() http.RoundTripper {
+	s.transportOnce.Do(func() {
+		s.transport = &http.Transport{
+			DialContext:         s.dialer().DialContext,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	})
+	return s.transport
+}
+
+// hopByHopHeaders are the headers of a single connection (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers and the headers listed by Connection.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// statusFromError maps an error of the dialer to a response status code.
+func statusFromError(err error) int {
+	var se *relay.StatusError
+	if errors.As(err, &se) && se.Status == relay.StatusForbidden {
+		return http.StatusForbidden
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// bufferedConn reads the data buffered by br before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
@@ -0,0 +1,146 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/http/proxy"
+	"github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/w/net/http/httptest"
+)
+
+// proxyClient returns a client of ts sending its requests through the proxy at proxyURL.
+func proxyClient(ts *httptest.Server, proxyURL string) *http.Client {
+	u, _ := url.Parse(proxyURL)
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(u)
+	return &http.Client{Transport: tr}
+}
+
+func get(t *testing.T, c *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp, string(b)
+}
+
+func newOrigin(t *testing.T, tls bool) *httptest.Server {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("Proxy-Authorization forwarded to the origin")
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		io.WriteString(w, "hello "+r.URL.Path)
+	})
+	var ts *httptest.Server
+	if tls {
+		ts = httptest.NewTLSServer(h)
+	} else {
+		ts = httptest.NewServer(h)
+	}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestServerForward(t *testing.T) {
+	origin := newOrigin(t, false)
+	px := httptest.NewServer(&Server{Authenticator: relay.StaticAuthenticator{"alice": "secret"}})
+	defer px.Close()
+
+	u, _ := url.Parse(px.URL)
+	u.User = url.UserPassword("alice", "secret")
+	resp, body := get(t, proxyClient(origin, u.String()), origin.URL+"/forward")
+	if resp.StatusCode != http.StatusOK || body != "hello /forward" {
+		t.Errorf("got %s %q, want 200 %q", resp.Status, body, "hello /forward")
+	}
+	if resp.Header.Get("X-Hop") != "" {
+		t.Error("hop-by-hop header X-Hop forwarded to the client")
+	}
+
+	resp, _ = get(t, proxyClient(origin, px.URL), origin.URL)
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("without credentials: got %s with challenge %q, want 407", resp.Status, resp.Header.Get("Proxy-Authenticate"))
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	origin := newOrigin(t, true)
+	px := httptest.NewServer(&Server{})
+	defer px.Close()
+
+	resp, body := get(t, proxyClient(origin, px.URL), origin.URL+"/connect")
+	if resp.StatusCode != http.StatusOK || body != "hello /connect" {
+		t.Errorf("got %s %q, want 200 %q", resp.Status, body, "hello /connect")
+	}
+}
+
+func TestServerConnectUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+
+	px := httptest.NewServer(&Server{})
+	defer px.Close()
+
+	_, err := proxyClient(px, px.URL).Get("https://" + closed)
+	if err == nil {
+		t.Fatal("Get through a CONNECT to a closed port succeeded")
+	}
+}
+
+func TestServerUpstreamProxy(t *testing.T) {
+	origin := newOrigin(t, true)
+
+	var hits atomic.Int32
+	upstream := &Server{Authenticator: relay.AuthenticatorFunc(func(_ context.Context, username, password string) bool {
+		hits.Add(1)
+		return username == "bob" && password == "pw"
+	})}
+	up := httptest.NewServer(upstream)
+	defer up.Close()
+
+	u, _ := url.Parse(up.URL)
+	u.User = url.UserPassword("bob", "pw")
+	px := httptest.NewServer(&Server{Dialer: &ConnectDialer{ProxyURL: u}})
+	defer px.Close()
+
+	resp, body := get(t, proxyClient(origin, px.URL), origin.URL+"/upstream")
+	if resp.StatusCode != http.StatusOK || body != "hello /upstream" {
+		t.Errorf("got %s %q, want 200 %q", resp.Status, body, "hello /upstream")
+	}
+	if hits.Load() == 0 {
+		t.Error("the request did not go through the upstream proxy")
+	}
+}
+
+func TestServerUpstreamRelay(t *testing.T) {
+	origin := newOrigin(t, false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go (&relay.Server{ACL: &relay.ACL{AllowPrivate: true}}).Serve(ln)
+
+	px := httptest.NewServer(&Server{Dialer: &relay.Client{Addr: ln.Addr().String()}})
+	defer px.Close()
+
+	resp, body := get(t, proxyClient(origin, px.URL), origin.URL+"/relay")
+	if resp.StatusCode != http.StatusOK || body != "hello /relay" {
+		t.Errorf("got %s %q, want 200 %q", resp.Status, body, "hello /relay")
+	}
+}
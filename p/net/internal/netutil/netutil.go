@@ -0,0 +1,77 @@
+// Package netutil provides the buffer pools and the bidirectional copy shared by the proxies.
+package netutil
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// BufferSize is the size of the buffers returned by GetBuffer.
+	BufferSize = 32 * 1024
+
+	// MaxDatagramSize is the size of the buffers returned by GetDatagramBuffer,
+	// the maximum payload of a UDP datagram.
+	MaxDatagramSize = 0xFFFF
+)
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, BufferSize)
+	},
+}
+
+// GetBuffer returns a buffer of BufferSize bytes from the pool.
+func GetBuffer() []byte {
+	return bufPool.Get().([]byte)
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer to the pool.
+func PutBuffer(b []byte) {
+	bufPool.Put(b)
+}
+
+var datagramPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, MaxDatagramSize)
+	},
+}
+
+// GetDatagramBuffer returns a buffer of MaxDatagramSize bytes from the pool, large enough
+// for any UDP datagram.
+func GetDatagramBuffer() []byte {
+	return datagramPool.Get().([]byte)
+}
+
+// PutDatagramBuffer returns a buffer obtained from GetDatagramBuffer to the pool.
+func PutDatagramBuffer(b []byte) {
+	datagramPool.Put(b)
+}
+
+// Transport copies data between rw1 and rw2 in both directions,
+// it returns when either direction is finished.
+func Transport(rw1, rw2 io.ReadWriter) error {
+	errc := make(chan error, 2)
+	go func() {
+		errc <- CopyBuffer(rw1, rw2)
+	}()
+
+	go func() {
+		errc <- CopyBuffer(rw2, rw1)
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// CopyBuffer copies from src to dst until EOF with a buffer from the pool.
+func CopyBuffer(dst io.Writer, src io.Reader) error {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	_, err := io.CopyBuffer(dst, src, buf)
+	return err
+}
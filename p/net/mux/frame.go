@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	version = 1
+
+	headerSize = 8
+
+	// maxFrameSize is the maximum length of frame data.
+	maxFrameSize = 0xFFFF
+)
+
+var (
+	ErrBadVersion = errors.New("mux: bad version")
+	ErrBadCommand = errors.New("mux: bad command")
+	ErrProtocol   = errors.New("mux: protocol error")
+)
+
+type cmdType uint8
+
+const (
+	cmdSYN  cmdType = iota // stream open
+	cmdFIN                 // stream close, a.k.a EOF mark
+	cmdPSH                 // data push
+	cmdUPD                 // window update, DATA is the 4-byte window increment
+	cmdRST                 // stream reset
+	cmdPING                // keepalive ping, DATA is echoed back in a PONG frame
+	cmdPONG                // keepalive pong
+)
+
+// frame is the basic unit of a session.
+//
+// Protocol spec:
+//
+//	+-----+-----+-----+-----+------+
+//	| VER | CMD | LEN | SID | DATA |
+//	+-----+-----+-----+-----+------+
+//	|  1  |  1  |  2  |  4  | VAR  |
+//	+-----+-----+-----+-----+------+
+//
+//	VER - protocol version, 1 byte.
+//	CMD - frame command, 1 byte.
+//	LEN - length of DATA, 2 bytes.
+//	SID - stream ID, 4 bytes.
+//	DATA - frame payload.
+type frame struct {
+	cmd  cmdType
+	sid  uint32
+	data []byte
+}
+
+func (f *frame) WriteTo(w io.Writer) (int64, error) {
+	if len(f.data) > maxFrameSize {
+		return 0, errors.New("mux: frame maximum length exceeded")
+	}
+	b := make([]byte, headerSize+len(f.data))
+	b[0] = version
+	b[1] = byte(f.cmd)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(f.data)))
+	binary.BigEndian.PutUint32(b[4:], f.sid)
+	copy(b[headerSize:], f.data)
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (f *frame) ReadFrom(r io.Reader) (n int64, err error) {
+	var header [headerSize]byte
+	nn, err := io.ReadFull(r, header[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	if header[0] != version {
+		err = ErrBadVersion
+		return
+	}
+	f.cmd = cmdType(header[1])
+	f.sid = binary.BigEndian.Uint32(header[4:])
+
+	f.data = nil
+	if dlen := int(binary.BigEndian.Uint16(header[2:])); dlen > 0 {
+		f.data = make([]byte, dlen)
+		nn, err = io.ReadFull(r, f.data)
+		n += int64(nn)
+	}
+	return
+}
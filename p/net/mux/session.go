@@ -0,0 +1,413 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	acceptBacklog = 1024
+
+	// controlBacklog is the number of frames the receive loop may queue in reply to the peer,
+	// the session is closed when the peer sends more than it reads.
+	controlBacklog = 1024
+
+	// initialStreamWindow is the receive window every stream starts with, a larger window
+	// is granted to the peer with a window update once the stream is opened.
+	initialStreamWindow = 256 * 1024
+)
+
+var (
+	ErrSessionClosed    = errors.New("mux: session closed")
+	ErrStreamsExhausted = errors.New("mux: stream IDs exhausted")
+	ErrKeepAliveTimeout = errors.New("mux: keepalive timeout")
+	ErrControlOverflow  = errors.New("mux: control frame queue overflow")
+)
+
+// Config is the configuration of a session, the zero value of a field means its default value.
+type Config struct {
+	// KeepAliveInterval is the interval between two keepalive pings, 10 seconds by default.
+	// A negative value disables keepalive.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout closes the session if nothing is received from the peer for
+	// this duration, 30 seconds by default.
+	KeepAliveTimeout time.Duration
+
+	// StreamWindow is the receive window of every stream, it is at least 256KB.
+	StreamWindow uint32
+}
+
+var DefaultConfig = Config{
+	KeepAliveInterval: 10 * time.Second,
+	KeepAliveTimeout:  30 * time.Second,
+	StreamWindow:      initialStreamWindow,
+}
+
+func (c *Config) withDefaults() Config {
+	cfg := DefaultConfig
+	if c == nil {
+		return cfg
+	}
+	if c.KeepAliveInterval != 0 {
+		cfg.KeepAliveInterval = c.KeepAliveInterval
+	}
+	if c.KeepAliveTimeout > 0 {
+		cfg.KeepAliveTimeout = c.KeepAliveTimeout
+	}
+	if c.StreamWindow > initialStreamWindow {
+		cfg.StreamWindow = c.StreamWindow
+	}
+	return cfg
+}
+
+// Session multiplexes streams over a single connection.
+//
+// The client side of a session opens odd-numbered streams and the server side even-numbered ones,
+// so both sides may open streams at the same time.
+//
+// The side opening a stream with an ID of the other side's parity gets a RST frame, and so
+// does the peer opening streams faster than they are accepted.
+//
+// Each stream has a receive window: a side never sends more data than the peer granted,
+// the window is replenished by UPD frames as the peer reads. A stream may be aborted with
+// a RST frame, RST is also the answer to data received for an unknown stream.
+// PING frames are sent every KeepAliveInterval and the session is closed when nothing
+// is received for KeepAliveTimeout.
+type Session struct {
+	conn   io.ReadWriteCloser
+	config Config
+
+	lastRecv atomic.Int64 // unix nano time of the last received frame
+
+	writeMu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex // protects nextID and streams
+	nextID  uint32
+	streams map[uint32]*Stream
+
+	accepts chan *Stream
+	control chan *frame // frames sent in reply to the peer, written by sendLoop
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client returns the client side of a session over conn. If config is nil, DefaultConfig is used.
+func Client(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, 1, config)
+}
+
+// Server returns the server side of a session over conn. If config is nil, DefaultConfig is used.
+func Server(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, 2, config)
+}
+
+func newSession(conn io.ReadWriteCloser, firstID uint32, config *Config) *Session {
+	s := &Session{
+		conn:    conn,
+		config:  config.withDefaults(),
+		nextID:  firstID,
+		streams: make(map[uint32]*Stream),
+		accepts: make(chan *Stream, acceptBacklog),
+		control: make(chan *frame, controlBacklog),
+		die:     make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.recvLoop()
+	go s.sendLoop()
+	if s.config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	s.mu.Lock()
+	if s.nextID > math.MaxUint32-2 {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	sid := s.nextID
+	s.nextID += 2
+	st := newStream(sid, s)
+	s.streams[sid] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(&frame{cmd: cmdSYN, sid: sid}); err != nil {
+		s.removeStream(sid)
+		return nil, err
+	}
+	if err := st.growWindow(); err != nil {
+		s.removeStream(sid)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.err()
+	}
+}
+
+// Accept implements net.Listener.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr implements net.Listener, it returns the local address of the underlying connection.
+func (s *Session) Addr() net.Addr {
+	return s.LocalAddr()
+}
+
+// Close closes the session and all of its streams.
+func (s *Session) Close() error {
+	return s.closeWithError(ErrSessionClosed)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel that is closed when the session is closed.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+// NumStreams returns the number of currently open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return muxAddr{}
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return muxAddr{}
+}
+
+func (s *Session) closeWithError(err error) error {
+	var closed bool
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.dieErr = err
+		s.mu.Unlock()
+		close(s.die)
+		closed = true
+	})
+	if !closed {
+		return ErrSessionClosed
+	}
+
+	s.mu.Lock()
+	for sid, st := range s.streams {
+		st.sessionClosed()
+		delete(s.streams, sid)
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+func (s *Session) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dieErr
+}
+
+func (s *Session) recvLoop() {
+	for {
+		f := &frame{}
+		if _, err := f.ReadFrom(s.conn); err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+
+		// The frames sent in reply are queued, the receive loop must never wait for the peer
+		// to read, which may be waiting for us to read in turn.
+		switch f.cmd {
+		case cmdSYN:
+			s.mu.Lock()
+			if f.sid == 0 || f.sid&1 == s.nextID&1 {
+				// The peer must not open a stream with one of our IDs.
+				s.mu.Unlock()
+				if !s.sendControl(&frame{cmd: cmdRST, sid: f.sid}) {
+					return
+				}
+				continue
+			}
+			if _, ok := s.streams[f.sid]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			st := newStream(f.sid, s)
+			s.streams[f.sid] = st
+			s.mu.Unlock()
+
+			select {
+			case s.accepts <- st:
+			default:
+				// The accept backlog is full.
+				s.removeStream(f.sid)
+				st.reset()
+				if !s.sendControl(&frame{cmd: cmdRST, sid: f.sid}) {
+					return
+				}
+				continue
+			}
+			if upd := st.growFrame(); upd != nil && !s.sendControl(upd) {
+				return
+			}
+		case cmdFIN:
+			if st := s.stream(f.sid); st != nil {
+				st.remoteClosed()
+			}
+		case cmdPSH:
+			st := s.stream(f.sid)
+			if st == nil {
+				if !s.sendControl(&frame{cmd: cmdRST, sid: f.sid}) {
+					return
+				}
+				continue
+			}
+			if !st.pushBytes(f.data) {
+				// The peer overran the receive window.
+				s.removeStream(f.sid)
+				st.reset()
+				if !s.sendControl(&frame{cmd: cmdRST, sid: f.sid}) {
+					return
+				}
+			}
+		case cmdUPD:
+			if len(f.data) != 4 {
+				s.closeWithError(ErrProtocol)
+				return
+			}
+			if st := s.stream(f.sid); st != nil {
+				st.updateWindow(binary.BigEndian.Uint32(f.data))
+			}
+		case cmdRST:
+			if st := s.stream(f.sid); st != nil {
+				s.removeStream(f.sid)
+				st.reset()
+			}
+		case cmdPING:
+			if !s.sendControl(&frame{cmd: cmdPONG, sid: f.sid, data: f.data}) {
+				return
+			}
+		case cmdPONG:
+		default:
+			s.closeWithError(ErrBadCommand)
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	t := time.NewTicker(s.config.KeepAliveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if time.Since(time.Unix(0, s.lastRecv.Load())) > s.config.KeepAliveTimeout {
+				s.closeWithError(ErrKeepAliveTimeout)
+				return
+			}
+			s.sendControl(&frame{cmd: cmdPING})
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// sendControl queues a frame for sendLoop, it closes the session and reports false if
+// the queue is full.
+func (s *Session) sendControl(f *frame) bool {
+	select {
+	case s.control <- f:
+		return true
+	default:
+		s.closeWithError(ErrControlOverflow)
+		return false
+	}
+}
+
+// sendLoop writes the frames queued by sendControl.
+func (s *Session) sendLoop() {
+	for {
+		select {
+		case f := <-s.control:
+			if err := s.writeFrame(f); err != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) stream(sid uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[sid]
+}
+
+func (s *Session) removeStream(sid uint32) {
+	s.mu.Lock()
+	delete(s.streams, sid)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(f *frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := f.WriteTo(s.conn); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string { return "mux" }
+func (muxAddr) String() string  { return "mux" }
@@ -0,0 +1,346 @@
+package mux_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/mux"
+	"github.com/gptlocal/netool/z/net/nettest"
+)
+
+func newSessionPair() (client, server *Session) {
+	c1, c2 := net.Pipe()
+	return Client(c1, nil), Server(c2, nil)
+}
+
+func TestStreamConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		client, server := newSessionPair()
+		st1, err := client.OpenStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		st2, err := server.AcceptStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stop = func() {
+			client.Close()
+			server.Close()
+		}
+		return st1, st2, stop, nil
+	})
+}
+
+func TestSessionOpenAccept(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream: %v", err)
+		}
+		if st.ID()%2 != 1 {
+			t.Errorf("client stream ID = %d, want odd", st.ID())
+		}
+
+		msg := bytes.Repeat([]byte{byte('a' + i)}, 100*1024)
+		go st.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(st, got); err != nil {
+			t.Fatalf("ReadFull: %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("stream %d: echoed data mismatch", st.ID())
+		}
+		st.Close()
+	}
+}
+
+func TestStreamCloseEOF(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if peer.ID() != st.ID() {
+		t.Errorf("accepted stream ID = %d, want %d", peer.ID(), st.ID())
+	}
+
+	st.Write([]byte("bye"))
+	st.Close()
+
+	b, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(b) != "bye" {
+		t.Errorf("got %q, want %q", b, "bye")
+	}
+	if _, err := st.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newSessionPair()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	server.Close()
+
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Error("Read on stream of closed session succeeded")
+	}
+	<-client.CloseChan()
+	if _, err := client.OpenStream(); err != ErrSessionClosed {
+		t.Errorf("OpenStream after close = %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	// The peer does not read, the write stops at the end of the receive window.
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(make([]byte, 1<<20))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if n != 256*1024 {
+		t.Errorf("Write wrote %d bytes, want %d", n, 256*1024)
+	}
+
+	// Other streams of the session are not blocked.
+	st2, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	peer2, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	go st2.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(peer2, b); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	// Reading replenishes the window.
+	st.SetWriteDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, 1<<20))
+		errc <- err
+	}()
+	if _, err := io.ReadFull(peer, make([]byte, n+1<<20)); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Write: %v", err)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	st.Write([]byte("discarded"))
+	st.Reset()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := peer.Read(make([]byte, 16))
+		if err == ErrStreamReset {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("Read = %v, want %v", err, ErrStreamReset)
+		}
+	}
+	if _, err := peer.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("Write after reset = %v, want %v", err, ErrStreamReset)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Errorf("server.NumStreams() = %d, want 0", n)
+	}
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := &Config{KeepAliveInterval: 10 * time.Millisecond, KeepAliveTimeout: 50 * time.Millisecond}
+
+	// The peer answers the pings, the session stays open.
+	client, server := Client(c1, config), Server(c2, &Config{KeepAliveInterval: -1})
+	time.Sleep(200 * time.Millisecond)
+	if client.IsClosed() {
+		t.Fatal("session closed while the peer is alive")
+	}
+	server.Close()
+	client.Close()
+
+	// The peer never reads, the session times out.
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	client = Client(c1, config)
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed after the keepalive timeout")
+	}
+	if _, err := client.AcceptStream(); err != ErrKeepAliveTimeout {
+		t.Errorf("AcceptStream = %v, want %v", err, ErrKeepAliveTimeout)
+	}
+}
+
+// rawFrame encodes a frame without data.
+func rawFrame(cmd byte, sid uint32) []byte {
+	return []byte{1, cmd, 0, 0, byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid)}
+}
+
+const (
+	rawSYN  = 0
+	rawRST  = 4
+	rawPING = 5
+)
+
+// readRawFrame reads a frame header from conn, skipping its data.
+func readRawFrame(t *testing.T, conn net.Conn) (cmd byte, sid uint32) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var b [8]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	io.CopyN(io.Discard, conn, int64(b[2])<<8|int64(b[3]))
+	return b[1], uint32(b[4])<<24 | uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])
+}
+
+func TestSessionPingFlood(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	client := Client(c1, &Config{KeepAliveInterval: -1})
+
+	// The peer pings without reading the pongs.
+	go func() {
+		for {
+			if _, err := c2.Write(rawFrame(rawPING, 0)); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed by a ping flood")
+	}
+	if _, err := client.AcceptStream(); err != ErrControlOverflow {
+		t.Errorf("AcceptStream = %v, want %v", err, ErrControlOverflow)
+	}
+}
+
+func TestSessionRejectsLocalStreamID(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	client := Client(c1, &Config{KeepAliveInterval: -1})
+	defer client.Close()
+
+	// Odd IDs belong to the client.
+	go c2.Write(rawFrame(rawSYN, 1))
+	if cmd, sid := readRawFrame(t, c2); cmd != rawRST || sid != 1 {
+		t.Fatalf("got frame %d for stream %d, want RST for stream 1", cmd, sid)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("NumStreams() = %d, want 0", n)
+	}
+
+	c2.SetReadDeadline(time.Time{})
+	go io.Copy(io.Discard, c2)
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if st.ID() != 1 {
+		t.Errorf("OpenStream got stream %d, want 1", st.ID())
+	}
+}
+
+func TestSessionAcceptBacklogFull(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	server := Server(c1, &Config{KeepAliveInterval: -1})
+	defer server.Close()
+
+	// Nobody accepts the streams, the receive loop must keep going.
+	go func() {
+		for sid := uint32(1); sid <= 2*1024+3; sid += 2 {
+			if _, err := c2.Write(rawFrame(rawSYN, sid)); err != nil {
+				return
+			}
+		}
+		c2.Write(rawFrame(rawPING, 0))
+	}()
+	var rst bool
+	for {
+		cmd, sid := readRawFrame(t, c2)
+		if cmd == rawRST && sid == 2*1024+1 {
+			rst = true
+		}
+		if cmd == rawPING+1 {
+			break
+		}
+	}
+	if !rst {
+		t.Error("no RST for the stream exceeding the accept backlog")
+	}
+}
@@ -0,0 +1,336 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrStreamReset = errors.New("mux: stream reset by peer")
+
+// Stream is a logical connection within a Session, it implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu         sync.Mutex // protects the fields below
+	buf        bytes.Buffer
+	finRecv    bool
+	rst        bool
+	unacked    uint32 // bytes read since the last window update
+	sendWindow int64  // bytes the peer is ready to receive
+
+	chReadEv  chan struct{}
+	chWriteEv chan struct{}
+
+	die     chan struct{}
+	dieOnce sync.Once
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:            id,
+		sess:          sess,
+		sendWindow:    initialStreamWindow,
+		chReadEv:      make(chan struct{}, 1),
+		chWriteEv:     make(chan struct{}, 1),
+		die:           make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// ID returns the stream ID.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		if st.rst {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.buf.Len() > 0 {
+			n, _ = st.buf.Read(b)
+			var inc uint32
+			st.unacked += uint32(n)
+			if st.unacked >= st.sess.config.StreamWindow/2 {
+				inc, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+
+			if inc > 0 {
+				st.sess.writeFrame(windowUpdate(st.id, inc))
+			}
+			return
+		}
+		finRecv := st.finRecv
+		st.mu.Unlock()
+
+		if finRecv {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-st.chReadEv:
+		case <-st.die:
+			return 0, io.ErrClosedPipe
+		case <-st.sess.die:
+			return 0, st.sess.err()
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write blocks while the receive window of the peer is exhausted.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		select {
+		case <-st.die:
+			return n, io.ErrClosedPipe
+		case <-st.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		default:
+		}
+
+		st.mu.Lock()
+		if st.rst {
+			st.mu.Unlock()
+			return n, ErrStreamReset
+		}
+		sz := int64(len(b))
+		if sz > maxFrameSize {
+			sz = maxFrameSize
+		}
+		if sz > st.sendWindow {
+			sz = st.sendWindow
+		}
+		st.sendWindow -= sz
+		st.mu.Unlock()
+
+		if sz == 0 {
+			select {
+			case <-st.chWriteEv:
+				continue
+			case <-st.die:
+				return n, io.ErrClosedPipe
+			case <-st.sess.die:
+				return n, st.sess.err()
+			case <-st.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			}
+		}
+
+		if err = st.sess.writeFrame(&frame{cmd: cmdPSH, sid: st.id, data: b[:sz]}); err != nil {
+			return
+		}
+		n += int(sz)
+		b = b[sz:]
+	}
+	return
+}
+
+// Close closes the stream and notifies the peer with a FIN frame,
+// the peer reads the pending data before io.EOF.
+func (st *Stream) Close() error {
+	return st.close(cmdFIN)
+}
+
+// Reset aborts the stream and notifies the peer with a RST frame,
+// the pending data is discarded and the peer gets ErrStreamReset.
+func (st *Stream) Reset() error {
+	return st.close(cmdRST)
+}
+
+func (st *Stream) close(cmd cmdType) error {
+	var once bool
+	st.dieOnce.Do(func() {
+		close(st.die)
+		once = true
+	})
+	if !once {
+		return io.ErrClosedPipe
+	}
+
+	st.sess.removeStream(st.id)
+	err := st.sess.writeFrame(&frame{cmd: cmd, sid: st.id})
+	if err == ErrSessionClosed {
+		err = nil
+	}
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// growWindow grants the peer the part of the receive window exceeding the initial one.
+func (st *Stream) growWindow() error {
+	if f := st.growFrame(); f != nil {
+		return st.sess.writeFrame(f)
+	}
+	return nil
+}
+
+// growFrame returns the window update sent by growWindow, or nil if the receive window is
+// the initial one.
+func (st *Stream) growFrame() *frame {
+	if inc := st.sess.config.StreamWindow - initialStreamWindow; inc > 0 {
+		return windowUpdate(st.id, inc)
+	}
+	return nil
+}
+
+// pushBytes buffers the data of a PSH frame, it reports false if b exceeds the receive window.
+func (st *Stream) pushBytes(b []byte) bool {
+	st.mu.Lock()
+	if int64(st.buf.Len())+int64(len(b)) > int64(st.sess.config.StreamWindow) {
+		st.mu.Unlock()
+		return false
+	}
+	st.buf.Write(b)
+	st.mu.Unlock()
+	st.notifyReadEvent()
+	return true
+}
+
+// updateWindow is called when a UPD frame is received.
+func (st *Stream) updateWindow(inc uint32) {
+	st.mu.Lock()
+	st.sendWindow += int64(inc)
+	st.mu.Unlock()
+	st.notifyWriteEvent()
+}
+
+// remoteClosed is called when a FIN frame is received.
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	st.notifyReadEvent()
+}
+
+// reset is called when a RST frame is received, or when the peer breaks the flow control.
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.rst = true
+	st.buf.Reset()
+	st.mu.Unlock()
+	st.notifyReadEvent()
+	st.notifyWriteEvent()
+}
+
+// sessionClosed is called when the session is closed.
+func (st *Stream) sessionClosed() {
+	st.notifyReadEvent()
+	st.notifyWriteEvent()
+}
+
+func (st *Stream) notifyReadEvent() {
+	select {
+	case st.chReadEv <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) notifyWriteEvent() {
+	select {
+	case st.chWriteEv <- struct{}{}:
+	default:
+	}
+}
+
+func windowUpdate(sid uint32, inc uint32) *frame {
+	f := &frame{cmd: cmdUPD, sid: sid, data: make([]byte, 4)}
+	binary.BigEndian.PutUint32(f.data, inc)
+	return f
+}
+
+// deadline is an abstraction for handling timeouts, borrowed from net.Pipe.
+type deadline struct {
+	mu     sync.Mutex // Guards timer and cancel
+	timer  *time.Timer
+	cancel chan struct{} // Must be non-nil
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
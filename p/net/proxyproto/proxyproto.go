@@ -0,0 +1,318 @@
+// Package proxyproto implements the PROXY protocol (versions 1 and 2), which carries the
+// addresses of the original connection from a proxy to the server behind it.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader  = errors.New("proxyproto: no PROXY protocol header")
+	ErrBadHeader = errors.New("proxyproto: malformed header")
+)
+
+// Command is the command of a version 2 header.
+type Command uint8
+
+const (
+	// Local is a connection established by the proxy itself, its addresses are not significant.
+	Local Command = 0x0
+	// Proxy is a connection relayed on behalf of a client.
+	Proxy Command = 0x1
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including the CRLF
+	v2HeaderLen = 16
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Address families and protocols of a version 2 header.
+const (
+	famUnspec = 0x00
+	famInet   = 0x10
+	famInet6  = 0x20
+	famUnix   = 0x30
+
+	protoStream = 0x01
+	protoDgram  = 0x02
+)
+
+// TLV is a type-length-value vector of a version 2 header.
+type TLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+
+	// Command is Proxy for a version 1 header, unless its protocol is UNKNOWN.
+	Command Command
+
+	// Source and Destination are the addresses of the original connection, *net.TCPAddr or
+	// *net.UDPAddr. They are nil for a Local command or an unsupported address family.
+	Source      net.Addr
+	Destination net.Addr
+
+	// TLVs are the vectors of a version 2 header, they are not sent in a version 1 header.
+	TLVs []TLV
+}
+
+// ReadHeader reads a PROXY protocol header of either version from r. It reads exactly the
+// bytes of the header, so that r can be used for the payload afterwards.
+//
+// It returns ErrNoHeader if r does not start with a header, in which case the bytes read are lost.
+func ReadHeader(r io.Reader) (*Header, error) {
+	b := make([]byte, len(v1Prefix), v1MaxLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(b) == v1Prefix:
+		return readV1(r, b)
+	case bytes.Equal(b, v2Signature[:len(b)]):
+		return readV2(r, b)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// readV1 reads the rest of a version 1 header starting with b:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readV1(r io.Reader, b []byte) (*Header, error) {
+	var c [1]byte
+	for {
+		if len(b) == v1MaxLength {
+			return nil, fmt.Errorf("%w: version 1 header too long", ErrBadHeader)
+		}
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = append(b, c[0])
+		if c[0] == '\n' {
+			break
+		}
+	}
+	line, ok := strings.CutSuffix(string(b), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: version 1 header without CRLF", ErrBadHeader)
+	}
+
+	fields := strings.Split(line, " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Command = Local
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrBadHeader, line)
+	}
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Command, h.Source, h.Destination = Proxy, src, dst
+	return h, nil
+}
+
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || strings.Contains(ip, ":") != (proto == "TCP6") {
+		return nil, fmt.Errorf("%w: bad %s address %q", ErrBadHeader, proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: bad port %q", ErrBadHeader, port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readV2 reads the rest of a version 2 header starting with b:
+//
+//	+-----------+---------+--------+--------+-----------+--------+
+//	| SIGNATURE | VER|CMD | FAM|PR |  LEN   | ADDRESSES |  TLVs  |
+//	+-----------+---------+--------+--------+-----------+--------+
+//	|    12     |    1    |   1    |   2    | Variable  |Variable|
+//	+-----------+---------+--------+--------+-----------+--------+
+func readV2(r io.Reader, b []byte) (*Header, error) {
+	b = b[:v2HeaderLen]
+	if _, err := io.ReadFull(r, b[len(v1Prefix):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b[:len(v2Signature)], v2Signature) {
+		return nil, ErrNoHeader
+	}
+	if b[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrBadHeader, b[12]>>4)
+	}
+	h := &Header{Version: 2, Command: Command(b[12] & 0x0F)}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, fmt.Errorf("%w: command %#x", ErrBadHeader, h.Command)
+	}
+	fam, proto := b[13]&0xF0, b[13]&0x0F
+
+	payload := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	var alen int
+	switch fam {
+	case famUnspec:
+	case famInet:
+		alen = 2*net.IPv4len + 4
+	case famInet6:
+		alen = 2*net.IPv6len + 4
+	case famUnix:
+		alen = 2 * 108
+	default:
+		return nil, fmt.Errorf("%w: address family %#x", ErrBadHeader, fam)
+	}
+	if len(payload) < alen {
+		return nil, fmt.Errorf("%w: addresses truncated", ErrBadHeader)
+	}
+	if h.Command == Proxy && (fam == famInet || fam == famInet6) && (proto == protoStream || proto == protoDgram) {
+		n := (alen - 4) / 2
+		src := net.IP(append([]byte(nil), payload[:n]...))
+		dst := net.IP(append([]byte(nil), payload[n:2*n]...))
+		sport := int(binary.BigEndian.Uint16(payload[2*n:]))
+		dport := int(binary.BigEndian.Uint16(payload[2*n+2:]))
+		if proto == protoStream {
+			h.Source, h.Destination = &net.TCPAddr{IP: src, Port: sport}, &net.TCPAddr{IP: dst, Port: dport}
+		} else {
+			h.Source, h.Destination = &net.UDPAddr{IP: src, Port: sport}, &net.UDPAddr{IP: dst, Port: dport}
+		}
+	}
+
+	for tlvs := payload[alen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: TLV truncated", ErrBadHeader)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: TLV truncated", ErrBadHeader)
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// WriteTo writes the header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// Format returns the encoding of the header.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown version %d", h.Version)
+	}
+}
+
+// addrs returns the IP addresses and ports of the header, ok is false if they are not
+// IP addresses. Both addresses are IPv6 if either is.
+func (h *Header) addrs() (src, dst net.IP, sport, dport int, ok bool) {
+	ipPort := func(a net.Addr) (net.IP, int, bool) {
+		switch a := a.(type) {
+		case *net.TCPAddr:
+			return a.IP, a.Port, a.IP != nil
+		case *net.UDPAddr:
+			return a.IP, a.Port, a.IP != nil
+		}
+		return nil, 0, false
+	}
+	src, sport, ok1 := ipPort(h.Source)
+	dst, dport, ok2 := ipPort(h.Destination)
+	if !ok1 || !ok2 {
+		return nil, nil, 0, 0, false
+	}
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		return src4, dst4, sport, dport, true
+	}
+	return src.To16(), dst.To16(), sport, dport, true
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	src, dst, sport, dport, ok := h.addrs()
+	if h.Command == Local || !ok {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	if _, udp := h.Source.(*net.UDPAddr); udp {
+		return nil, errors.New("proxyproto: version 1 does not support UDP")
+	}
+	proto := "TCP4"
+	if len(src) == net.IPv6len {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src, dst, sport, dport)), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var payload bytes.Buffer
+	famProto := byte(famUnspec)
+	if src, dst, sport, dport, ok := h.addrs(); ok && h.Command == Proxy {
+		famProto = famInet
+		if len(src) == net.IPv6len {
+			famProto = famInet6
+		}
+		if _, udp := h.Source.(*net.UDPAddr); udp {
+			famProto |= protoDgram
+		} else {
+			famProto |= protoStream
+		}
+		payload.Write(src)
+		payload.Write(dst)
+		binary.Write(&payload, binary.BigEndian, uint16(sport))
+		binary.Write(&payload, binary.BigEndian, uint16(dport))
+	}
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, errors.New("proxyproto: TLV too long")
+		}
+		payload.WriteByte(tlv.Type)
+		binary.Write(&payload, binary.BigEndian, uint16(len(tlv.Value)))
+		payload.Write(tlv.Value)
+	}
+	if payload.Len() > 0xFFFF {
+		return nil, errors.New("proxyproto: header too long")
+	}
+
+	b := make([]byte, 0, v2HeaderLen+payload.Len())
+	b = append(b, v2Signature...)
+	b = append(b, 0x20|byte(h.Command&0x0F), famProto)
+	b = binary.BigEndian.AppendUint16(b, uint16(payload.Len()))
+	return append(b, payload.Bytes()...), nil
+}
@@ -0,0 +1,194 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/proxyproto"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestReadHeaderV1(t *testing.T) {
+	tests := []struct {
+		in       string
+		cmd      Command
+		src, dst string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", Proxy, "192.0.2.1:56324", "198.51.100.1:443"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1 65535\r\n", Proxy, "[2001:db8::1]:1", "[2001:db8::2]:65535"},
+		{"PROXY UNKNOWN\r\n", Local, "", ""},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", Local, "", ""},
+	}
+	for _, tt := range tests {
+		r := strings.NewReader(tt.in + "payload")
+		h, err := ReadHeader(r)
+		if err != nil {
+			t.Errorf("ReadHeader(%q): %v", tt.in, err)
+			continue
+		}
+		if h.Version != 1 || h.Command != tt.cmd {
+			t.Errorf("ReadHeader(%q) = version %d command %d, want 1 and %d", tt.in, h.Version, h.Command, tt.cmd)
+		}
+		if tt.src != "" && (h.Source.String() != tt.src || h.Destination.String() != tt.dst) {
+			t.Errorf("ReadHeader(%q) = %s -> %s, want %s -> %s", tt.in, h.Source, h.Destination, tt.src, tt.dst)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("ReadHeader(%q) left %q, want the payload", tt.in, rest)
+		}
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	// PROXY TCP4 127.0.0.1:56324 -> 127.0.0.1:443 with an ALPN TLV "h2".
+	b := mustHex("0d0a0d0a000d0a515549540a 21 11 0011 7f000001 7f000001 dc04 01bb 01 0002 6832")
+	r := bytes.NewReader(append(b, "payload"...))
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	want := &Header{
+		Version:     2,
+		Command:     Proxy,
+		Source:      tcpAddr("127.0.0.1:56324"),
+		Destination: tcpAddr("127.0.0.1:443"),
+		TLVs:        []TLV{{Type: 0x01, Value: []byte("h2")}},
+	}
+	h.Source.(*net.TCPAddr).IP = h.Source.(*net.TCPAddr).IP.To16()
+	h.Destination.(*net.TCPAddr).IP = h.Destination.(*net.TCPAddr).IP.To16()
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("ReadHeader = %+v, want %+v", h, want)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+		t.Errorf("ReadHeader left %q, want the payload", rest)
+	}
+
+	got, err := want.Format()
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("Format = %x, want %x", got, b)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, h := range []*Header{
+		{Version: 1, Command: Proxy, Source: tcpAddr("192.0.2.1:1"), Destination: tcpAddr("192.0.2.2:2")},
+		{Version: 1, Command: Proxy, Source: tcpAddr("[2001:db8::1]:1"), Destination: tcpAddr("[2001:db8::2]:2")},
+		{Version: 1, Command: Local},
+		{Version: 2, Command: Proxy, Source: tcpAddr("[2001:db8::1]:1"), Destination: tcpAddr("[2001:db8::2]:2"),
+			TLVs: []TLV{{Type: 0x02, Value: []byte("example.com")}, {Type: 0xE0, Value: []byte{}}}},
+		{Version: 2, Command: Proxy, Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 53}, Destination: &net.UDPAddr{IP: net.ParseIP("192.0.2.2").To4(), Port: 53}},
+		{Version: 2, Command: Local},
+	} {
+		var buf bytes.Buffer
+		if _, err := h.WriteTo(&buf); err != nil {
+			t.Errorf("WriteTo(%+v): %v", h, err)
+			continue
+		}
+		enc := buf.String()
+		got, err := ReadHeader(&buf)
+		if err != nil {
+			t.Errorf("ReadHeader(%q): %v", enc, err)
+			continue
+		}
+		if got.Version != h.Version || got.Command != h.Command || len(got.TLVs) != len(h.TLVs) {
+			t.Errorf("ReadHeader(%q) = %+v, want %+v", enc, got, h)
+		}
+		if h.Source != nil && (got.Source.String() != h.Source.String() || got.Destination.String() != h.Destination.String()) {
+			t.Errorf("ReadHeader(%q) = %s -> %s, want %s -> %s", enc, got.Source, got.Destination, h.Source, h.Destination)
+		}
+	}
+}
+
+func TestReadHeaderMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), ErrNoHeader},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\n"), ErrBadHeader},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("x", 120) + "\r\n"), ErrBadHeader},
+		{"v1 bad proto", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 1 2\r\n"), ErrBadHeader},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 192.0.2.2 1 2\r\n"), ErrBadHeader},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 2\r\n"), ErrBadHeader},
+		{"v1 leading zero", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 01 2\r\n"), ErrBadHeader},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1\r\n"), ErrBadHeader},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), io.ErrUnexpectedEOF},
+		{"v2 bad signature", mustHex("0d0a0d0a000d0a5155495421 21 11 000c"), ErrNoHeader},
+		{"v2 bad version", mustHex("0d0a0d0a000d0a515549540a 11 11 0000"), ErrBadHeader},
+		{"v2 bad command", mustHex("0d0a0d0a000d0a515549540a 22 11 0000"), ErrBadHeader},
+		{"v2 bad family", mustHex("0d0a0d0a000d0a515549540a 21 41 0000"), ErrBadHeader},
+		{"v2 short addresses", mustHex("0d0a0d0a000d0a515549540a 21 11 0004 7f000001"), ErrBadHeader},
+		{"v2 truncated TLV", mustHex("0d0a0d0a000d0a515549540a 21 00 0003 010005"), ErrBadHeader},
+		{"v2 truncated payload", mustHex("0d0a0d0a000d0a515549540a 21 11 000c 7f"), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := ReadHeader(bytes.NewReader(tt.in)); !errors.Is(err, tt.err) {
+			t.Errorf("%s: ReadHeader(%q) = %v, want %v", tt.name, tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	udp := &Header{Version: 1, Command: Proxy, Source: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, Destination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}}
+	if _, err := udp.Format(); err == nil {
+		t.Error("Format of a version 1 UDP header succeeded")
+	}
+	if _, err := (&Header{Version: 3}).Format(); err == nil {
+		t.Error("Format of version 3 succeeded")
+	}
+	long := &Header{Version: 2, TLVs: []TLV{{Value: make([]byte, 0x10000)}}}
+	if _, err := long.Format(); err == nil {
+		t.Error("Format of a TLV too long succeeded")
+	}
+}
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1 65535\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add(mustHex("0d0a0d0a000d0a515549540a 21 11 0011 7f000001 7f000001 dc04 01bb 01 0002 6832"))
+	f.Add(mustHex("0d0a0d0a000d0a515549540a 20 00 0000"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := ReadHeader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		enc, err := h.Format()
+		if err != nil {
+			t.Fatalf("Format(%+v): %v", h, err)
+		}
+		h2, err := ReadHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatalf("ReadHeader of re-encoded %q: %v", b, err)
+		}
+		enc2, err := h2.Format()
+		if err != nil || !bytes.Equal(enc, enc2) {
+			t.Fatalf("round trip of %q: got %q, %v; want %q", b, enc2, err, enc)
+		}
+	})
+}
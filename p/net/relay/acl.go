@@ -0,0 +1,301 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrDestinationDenied = errors.New("relay: destination denied by access rules")
+
+// Action is the decision of a matching Rule.
+type Action uint8
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+// Rule matches the destinations of requests.
+type Rule struct {
+	Action Action
+
+	// Users are the usernames the rule applies to, the rule applies to every user if empty.
+	// The anonymous user is "".
+	Users []string
+
+	// Hosts are CIDR ranges ("10.0.0.0/8"), IP addresses, domain names ("example.com") and
+	// domain wildcards ("*.example.com" matches the subdomains of example.com).
+	// The rule applies to every host if empty.
+	Hosts []string
+
+	// Ports are ports ("443") and port ranges ("8000-8999"),
+	// the rule applies to every port if empty.
+	Ports []string
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+type rule struct {
+	action  Action
+	users   map[string]bool
+	nets    []*net.IPNet
+	domains []string // lower case, a leading "*." matches the subdomains
+	ports   []portRange
+}
+
+// ACL is an ordered list of access rules, the first rule matching a destination decides.
+// A destination matched by no rule is allowed, unless DefaultDeny is set.
+//
+// Loopback, link-local, private and unspecified addresses are denied, unless AllowPrivate is set
+// or they are allowed by a rule listing a CIDR range or IP address containing them.
+// The rules are matched against the resolved addresses when the server dials the destination,
+// so a domain name cannot be used to reach a denied address.
+type ACL struct {
+	AllowPrivate bool
+	DefaultDeny  bool
+
+	rules []rule
+}
+
+// NewACL compiles rules into an ACL.
+func NewACL(rules ...Rule) (*ACL, error) {
+	a := &ACL{}
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("relay: rule %d: %w", i, err)
+		}
+		a.rules = append(a.rules, cr)
+	}
+	return a, nil
+}
+
+func compileRule(r Rule) (rule, error) {
+	cr := rule{action: r.Action}
+	if r.Action != Allow && r.Action != Deny {
+		return cr, fmt.Errorf("bad action %d", r.Action)
+	}
+	if len(r.Users) > 0 {
+		cr.users = make(map[string]bool)
+		for _, u := range r.Users {
+			cr.users[u] = true
+		}
+	}
+
+	for _, h := range r.Hosts {
+		if strings.Contains(h, "/") {
+			_, ipnet, err := net.ParseCIDR(h)
+			if err != nil {
+				return cr, err
+			}
+			cr.nets = append(cr.nets, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			cr.nets = append(cr.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		d := strings.ToLower(strings.TrimSuffix(h, "."))
+		if d == "" || strings.Contains(strings.TrimPrefix(d, "*."), "*") {
+			return cr, fmt.Errorf("bad host pattern %q", h)
+		}
+		cr.domains = append(cr.domains, d)
+	}
+
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return cr, err
+		}
+		cr.ports = append(cr.ports, pr)
+	}
+	return cr, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	t, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || t < f {
+		return portRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	return portRange{from: uint16(f), to: uint16(t)}, nil
+}
+
+// Allowed reports whether user may reach port on host, ip is the resolved address of host
+// or nil if unknown. host may be an IP address.
+func (a *ACL) Allowed(user, host string, ip net.IP, port uint16) bool {
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	private := ip != nil && isPrivateIP(ip) && !a.AllowPrivate
+
+	for i := range a.rules {
+		r := &a.rules[i]
+		if !r.matchUser(user) || !r.matchPort(port) {
+			continue
+		}
+		if len(r.nets) == 0 && len(r.domains) == 0 {
+			if r.action == Allow && private {
+				return false
+			}
+			return r.action == Allow
+		}
+		if r.matchIP(ip) {
+			return r.action == Allow
+		}
+		if r.matchDomain(host) {
+			if r.action == Allow && private {
+				return false
+			}
+			return r.action == Allow
+		}
+	}
+	return !private && !a.DefaultDeny
+}
+
+func (r *rule) matchUser(user string) bool {
+	return r.users == nil || r.users[user]
+}
+
+func (r *rule) matchPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.domains {
+		if suffix, ok := strings.CutPrefix(d, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == d {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// dial connects to the destination of a request if the ACL allows it.
+//
+// The default dialer checks every address the destination resolves to before connecting.
+// A custom Dialer is given the allowed addresses the destination resolves to in turn, so that
+// the destination cannot resolve to another address when the Dialer connects.
+func (s *Server) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	acl := s.acl()
+	user := userFromContext(ctx)
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Dialer != nil {
+		ips, err := resolveAllowed(ctx, acl, user, host, port)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = s.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			ipstr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !acl.Allowed(user, host, net.ParseIP(ipstr), port) {
+				return ErrDestinationDenied
+			}
+			return nil
+		},
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// resolveAllowed resolves host and returns the addresses the ACL allows user to reach on port.
+// It returns ErrDestinationDenied if none is allowed.
+func resolveAllowed(ctx context.Context, acl *ACL, user, host string, port uint16) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if acl.Allowed(user, host, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, ErrDestinationDenied
+	}
+	return allowed, nil
+}
+
+func splitHostPort(address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("relay: bad port in %q", address)
+	}
+	return host, uint16(p), nil
+}
@@ -0,0 +1,186 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestACLAllowed(t *testing.T) {
+	acl, err := NewACL(
+		Rule{Action: Deny, Hosts: []string{"*.internal.example.com"}},
+		Rule{Action: Allow, Users: []string{"admin"}, Hosts: []string{"10.1.0.0/16"}, Ports: []string{"22", "8000-8999"}},
+		Rule{Action: Deny, Hosts: []string{"203.0.113.7"}},
+		Rule{Action: Deny, Ports: []string{"25"}},
+		Rule{Action: Allow, Users: []string{"dev"}, Hosts: []string{"db.example.com"}},
+	)
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+
+	tests := []struct {
+		user string
+		host string
+		ip   string
+		port uint16
+		want bool
+	}{
+		{"", "example.com", "", 443, true},
+		{"", "example.com", "93.184.216.34", 443, true},
+		{"", "api.internal.example.com", "", 443, false},
+		{"", "API.Internal.Example.COM.", "", 443, false},
+		{"", "internal.example.com", "", 443, true},
+		{"", "203.0.113.7", "", 443, false},
+		{"", "203.0.113.8", "", 443, true},
+		{"", "example.com", "203.0.113.7", 443, false},
+		{"", "mail.example.com", "", 25, false},
+
+		// Private addresses.
+		{"", "127.0.0.1", "", 80, false},
+		{"", "localhost", "::1", 80, false},
+		{"", "192.168.1.1", "", 80, false},
+		{"", "169.254.169.254", "", 80, false},
+		{"", "fe80::1", "", 80, false},
+		{"", "0.0.0.0", "", 80, false},
+		{"", "::ffff:10.0.0.1", "", 80, false},
+
+		// Per-user rules, a CIDR range may allow private addresses.
+		{"admin", "10.1.2.3", "", 22, true},
+		{"admin", "10.1.2.3", "", 8080, true},
+		{"admin", "10.1.2.3", "", 80, false},
+		{"admin", "10.2.0.1", "", 22, false},
+		{"guest", "10.1.2.3", "", 22, false},
+
+		// A domain rule does not allow a private address.
+		{"dev", "db.example.com", "", 5432, true},
+		{"dev", "db.example.com", "10.1.2.3", 5432, false},
+	}
+	for _, tt := range tests {
+		var ip net.IP
+		if tt.ip != "" {
+			ip = net.ParseIP(tt.ip)
+		}
+		if got := acl.Allowed(tt.user, tt.host, ip, tt.port); got != tt.want {
+			t.Errorf("Allowed(%q, %q, %v, %d) = %v, want %v", tt.user, tt.host, ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestACLDefaultDeny(t *testing.T) {
+	acl, err := NewACL(Rule{Action: Allow, Hosts: []string{"example.com"}, Ports: []string{"443"}})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+	acl.DefaultDeny = true
+	if !acl.Allowed("", "example.com", nil, 443) {
+		t.Error("example.com:443 denied")
+	}
+	if acl.Allowed("", "example.org", nil, 443) {
+		t.Error("example.org:443 allowed")
+	}
+
+	acl = &ACL{AllowPrivate: true}
+	if !acl.Allowed("", "127.0.0.1", nil, 80) {
+		t.Error("127.0.0.1:80 denied with AllowPrivate")
+	}
+}
+
+func TestNewACLErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: Allow, Hosts: []string{"10.0.0.0/33"}},
+		{Action: Allow, Hosts: []string{"foo.*.example.com"}},
+		{Action: Allow, Ports: []string{"70000"}},
+		{Action: Allow, Ports: []string{"90-80"}},
+		{Action: Action(7)},
+	} {
+		if _, err := NewACL(r); err == nil {
+			t.Errorf("NewACL(%+v) succeeded", r)
+		}
+	}
+}
+
+func TestServerACL(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// The default ACL blocks loopback destinations, including the domains resolving to them.
+	ln := startRelayServer(t, &Server{ACL: &ACL{}})
+	c := &Client{Addr: ln.Addr().String()}
+	for _, address := range []string{echo.Addr().String(), net.JoinHostPort("localhost", port)} {
+		_, err := c.Dial("tcp", address)
+		var se *StatusError
+		if !errors.As(err, &se) || se.Status != StatusForbidden {
+			t.Errorf("Dial %s: err = %v, want %v", address, err, &StatusError{Status: StatusForbidden})
+		}
+	}
+
+	// A per-user rule opens the loopback range to alice only.
+	acl, err := NewACL(Rule{Action: Allow, Users: []string{"alice"}, Hosts: []string{"127.0.0.0/8"}, Ports: []string{port}})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+	ln = startRelayServer(t, &Server{
+		ACL:           acl,
+		Authenticator: StaticAuthenticator{"alice": "secret", "bob": "secret"},
+	})
+	c = &Client{Addr: ln.Addr().String(), Username: "alice", Password: "secret"}
+	if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+		t.Errorf("Dial as alice: %v", err)
+	}
+	c = &Client{Addr: ln.Addr().String(), Username: "bob", Password: "secret"}
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial as bob succeeded")
+	}
+}
+
+// recordingDialer records the addresses it dials.
+type recordingDialer struct {
+	mu        sync.Mutex
+	addresses []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addresses = append(d.addresses, address)
+	d.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestServerACLCustomDialer(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// A domain resolving to a loopback address is denied before reaching the Dialer.
+	d := &recordingDialer{}
+	ln := startRelayServer(t, &Server{ACL: &ACL{}, Dialer: d})
+	c := &Client{Addr: ln.Addr().String()}
+	_, err := c.Dial("tcp", net.JoinHostPort("localhost", port))
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != StatusForbidden {
+		t.Errorf("Dial localhost: err = %v, want status %#x", err, StatusForbidden)
+	}
+	if len(d.addresses) != 0 {
+		t.Errorf("Dialer called with %v", d.addresses)
+	}
+
+	// The Dialer is given the checked address.
+	ln = startRelayServer(t, &Server{Dialer: d})
+	c = &Client{Addr: ln.Addr().String()}
+	if err := checkEcho(t, c, net.JoinHostPort("localhost", port)); err != nil {
+		t.Fatalf("Dial localhost with AllowPrivate: %v", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.addresses) == 0 {
+		t.Fatal("Dialer not called")
+	}
+	for _, address := range d.addresses {
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host) == nil {
+			t.Errorf("Dialer called with %s, want an IP address", address)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+// Authenticator verifies the username and password carried by a UserAuthFeature.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) bool
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator.
+type AuthenticatorFunc func(ctx context.Context, username, password string) bool
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, username, password string) bool {
+	return f(ctx, username, password)
+}
+
+// StaticAuthenticator authenticates users against a fixed username to password map.
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(ctx context.Context, username, password string) bool {
+	v, ok := a[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(v), []byte(password)) == 1
+}
+
+const defaultReloadInterval = 5 * time.Second
+
+// FileAuthenticator authenticates users against an htpasswd-style file, in which each line
+// has the form "username:hash" and the hash is a bcrypt hash ($2a$, $2b$ or $2y$).
+// Empty lines and lines starting with '#' are ignored.
+//
+// The file is reloaded when its modification time or size changes, it is checked at most
+// once per ReloadInterval during authentication.
+type FileAuthenticator struct {
+	// ReloadInterval is the minimum interval between two checks of the file. Zero means 5 seconds.
+	ReloadInterval time.Duration
+
+	path string
+
+	mu        sync.Mutex
+	users     map[string][]byte
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+}
+
+// NewFileAuthenticator loads the htpasswd file at path.
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.load(fi); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) Authenticate(ctx context.Context, username, password string) bool {
+	a.reloadIfChanged()
+
+	a.mu.Lock()
+	hash, ok := a.users[username]
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func (a *FileAuthenticator) reloadIfChanged() {
+	interval := a.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	a.mu.Lock()
+	if time.Since(a.checkedAt) < interval {
+		a.mu.Unlock()
+		return
+	}
+	a.checkedAt = time.Now()
+	changed := true
+	fi, err := os.Stat(a.path)
+	if err == nil {
+		changed = !fi.ModTime().Equal(a.modTime) || fi.Size() != a.size
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		log.Printf("relay: auth file %s: %v", a.path, err)
+		return
+	}
+	if changed {
+		if err := a.load(fi); err != nil {
+			log.Printf("relay: reload auth file %s: %v", a.path, err)
+		}
+	}
+}
+
+func (a *FileAuthenticator) load(fi os.FileInfo) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("%s:%d: malformed entry", a.path, lineno)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return fmt.Errorf("%s:%d: unsupported hash for user %s, only bcrypt is supported", a.path, lineno, username)
+		}
+		users[username] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+	a.mu.Unlock()
+	return nil
+}
+
+type userKey struct{}
+
+func contextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userFromContext returns the authenticated username of the request, "" for anonymous requests.
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// authenticate checks the UserAuthFeature of req, it returns the authenticated username.
+// A request over a TLS connection with a verified client certificate is authenticated by the
+// certificate, otherwise every request is accepted anonymously if no Authenticator is configured.
+func (s *Server) authenticate(ctx context.Context, req *Request, cs *tls.ConnectionState) (string, bool) {
+	if user := s.certUser(cs); user != "" {
+		return user, true
+	}
+
+	var username, password string
+	for _, f := range req.Features {
+		if f, ok := f.(*features.UserAuthFeature); ok {
+			username, password = f.Username, f.Password
+		}
+	}
+	if s.Authenticator == nil {
+		return "", true
+	}
+	return username, s.Authenticator.Authenticate(ctx, username, password)
+}
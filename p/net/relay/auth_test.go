@@ -0,0 +1,110 @@
+package relay_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestServerAuthenticator(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{
+		Authenticator: StaticAuthenticator{"alice": "secret"},
+	})
+
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		c := &Client{Addr: ln.Addr().String(), Username: tt.username, Password: tt.password}
+		conn, err := c.Dial("tcp", echo.Addr().String())
+		if (err == nil) != tt.ok {
+			t.Errorf("Dial as %q/%q: err = %v, want success %v", tt.username, tt.password, err, tt.ok)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestAuthenticatorFunc(t *testing.T) {
+	a := AuthenticatorFunc(func(ctx context.Context, username, password string) bool {
+		return username == password
+	})
+	if !a.Authenticate(context.Background(), "x", "x") {
+		t.Error("Authenticate(x, x) = false, want true")
+	}
+	if a.Authenticate(context.Background(), "x", "y") {
+		t.Error("Authenticate(x, y) = true, want false")
+	}
+}
+
+func writeHtpasswd(t *testing.T, path string, users map[string]string) {
+	t.Helper()
+	var b []byte
+	b = append(b, "# relay users\n"...)
+	for u, p := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("bcrypt: %v", err)
+		}
+		b = append(b, u+":"+string(hash)+"\n"...)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestFileAuthenticatorReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+
+	a, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatalf("NewFileAuthenticator: %v", err)
+	}
+	a.ReloadInterval = time.Millisecond
+
+	ctx := context.Background()
+	if !a.Authenticate(ctx, "alice", "secret") {
+		t.Error("alice rejected")
+	}
+	if a.Authenticate(ctx, "alice", "wrong") {
+		t.Error("alice accepted with a wrong password")
+	}
+	if a.Authenticate(ctx, "bob", "hunter2") {
+		t.Error("unknown user bob accepted")
+	}
+
+	writeHtpasswd(t, path, map[string]string{"bob": "hunter2"})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	time.Sleep(5 * time.Millisecond)
+
+	if !a.Authenticate(ctx, "bob", "hunter2") {
+		t.Error("bob rejected after reload")
+	}
+	if a.Authenticate(ctx, "alice", "secret") {
+		t.Error("alice accepted after being removed from the file")
+	}
+}
+
+func TestFileAuthenticatorRejectsPlainHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(path, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if _, err := NewFileAuthenticator(path); err == nil {
+		t.Error("NewFileAuthenticator accepted a non-bcrypt hash")
+	}
+}
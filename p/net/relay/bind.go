@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/mux"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+// Listener creates the listeners for BIND requests, net.ListenConfig satisfies this interface.
+type Listener interface {
+	Listen(ctx context.Context, network, address string) (net.Listener, error)
+}
+
+// Addr is a network address reported by the relay server.
+type Addr struct {
+	Net     string
+	Address string
+}
+
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+func (a *Addr) String() string {
+	return a.Address
+}
+
+// handleBind listens on the requested address and forwards every accepted connection
+// to the client over a new stream of a mux session running on conn.
+//
+// Each stream starts with a Response carrying the AddrFeature of the inbound peer.
+// The requested address is checked by bindAddress.
+func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request) {
+	if tf := tunnelOf(req); tf != nil {
+		s.handleConnector(ctx, conn, req, tf)
+		return
+	}
+
+	network, address := targetOf(req)
+	if address == "" {
+		address = ":0"
+	}
+	if network != "tcp" {
+		log.Printf("relay: %s: unsupported network %s", conn.RemoteAddr(), network)
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+
+	laddr, err := s.bindAddress(ctx, address)
+	if err != nil {
+		log.Printf("relay: %s: bind %s: %v", conn.RemoteAddr(), address, err)
+		writeResponse(conn, req.Version, StatusFromError(err))
+		return
+	}
+
+	ln, err := s.listener().Listen(ctx, network, laddr)
+	if err != nil {
+		log.Printf("relay: %s: listen %s/%s: %v", conn.RemoteAddr(), address, network, err)
+		writeResponse(conn, req.Version, StatusFromError(err))
+		return
+	}
+	defer ln.Close()
+
+	af := &features.AddrFeature{}
+	af.ParseFrom(ln.Addr().String())
+	if err := writeResponse(conn, req.Version, StatusOK, af); err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	sess := mux.Server(conn, nil)
+	defer sess.Close()
+	go func() {
+		<-sess.CloseChan()
+		ln.Close()
+	}()
+
+	for {
+		rc, err := ln.Accept()
+		if err != nil {
+			log.Printf("relay: %s: bind on %s: %v", conn.RemoteAddr(), ln.Addr(), err)
+			return
+		}
+		go s.forwardBind(sess, rc)
+	}
+}
+
+// bindAddress checks the address of a BIND request against BindPorts and the ACL, like the
+// destination of a CONNECT request, and returns the address to listen on.
+func (s *Server) bindAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if port != 0 {
+		allowed := false
+		for _, p := range s.BindPorts {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return "", err
+			}
+			if port >= pr.from && port <= pr.to {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", ErrDestinationDenied
+		}
+	}
+	if host == "" {
+		host = net.IPv4zero.String()
+	}
+	ips, err := resolveAllowed(ctx, s.acl(), userFromContext(ctx), host, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), strconv.Itoa(int(port))), nil
+}
+
+func (s *Server) forwardBind(sess *mux.Session, rc net.Conn) {
+	defer rc.Close()
+
+	st, err := sess.OpenStream()
+	if err != nil {
+		log.Printf("relay: %s: open stream: %v", sess.RemoteAddr(), err)
+		return
+	}
+	defer st.Close()
+
+	af := &features.AddrFeature{}
+	af.ParseFrom(rc.RemoteAddr().String())
+	if err := writeResponse(st, Version1, StatusOK, af); err != nil {
+		return
+	}
+
+	if err := netutil.Transport(st, rc); err != nil {
+		log.Printf("relay: %s <-> %s: %v", rc.RemoteAddr(), sess.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) listener() Listener {
+	if s.Listener != nil {
+		return s.Listener
+	}
+	return &net.ListenConfig{}
+}
+
+// bindListener is the client side of a BIND request or a tunnel connector.
+type bindListener struct {
+	sess *mux.Session
+	addr *Addr
+	udp  bool // the streams carry datagrams
+}
+
+// Accept reads the header of the next stream, its first AddrFeature is the address of
+// the peer and the optional second one is the destination requested by the peer.
+func (ln *bindListener) Accept() (net.Conn, error) {
+	for {
+		st, err := ln.sess.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &Response{}
+		if _, err := resp.ReadFrom(st); err != nil {
+			st.Close()
+			continue
+		}
+		conn := &bindConn{Stream: st, laddr: ln.addr, raddr: &Addr{Net: ln.addr.Net}}
+		var n int
+		for _, f := range resp.Features {
+			if f, ok := f.(*features.AddrFeature); ok {
+				switch n {
+				case 0:
+					conn.raddr.Address = f.String()
+				case 1:
+					conn.laddr = &Addr{Net: ln.addr.Net, Address: f.String()}
+				}
+				n++
+			}
+		}
+		if ln.udp {
+			return &packetConn{Conn: conn, laddr: conn.laddr, raddr: conn.raddr}, nil
+		}
+		return conn, nil
+	}
+}
+
+func (ln *bindListener) Close() error {
+	return ln.sess.Close()
+}
+
+func (ln *bindListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// bindConn is a connection accepted by the relay server on behalf of the client.
+type bindConn struct {
+	*mux.Stream
+	laddr *Addr
+	raddr *Addr
+}
+
+func (c *bindConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
@@ -0,0 +1,119 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestClientBind(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	bln, err := c.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	defer bln.Close()
+
+	go func() {
+		for {
+			conn, err := bln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", bln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial bound address %s: %v", bln.Addr(), err)
+		}
+		msg := []byte("hello from behind NAT")
+		conn.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != string(msg) {
+			t.Errorf("got %q, want %q", got, msg)
+		}
+		conn.Close()
+	}
+}
+
+func TestClientBindCloseReleasesPort(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	bln, err := c.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	peer := make(chan net.Addr, 1)
+	go func() {
+		conn, err := bln.Accept()
+		if err != nil {
+			close(peer)
+			return
+		}
+		peer <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", bln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial bound address: %v", err)
+	}
+	defer conn.Close()
+	if addr := <-peer; addr == nil || addr.String() != conn.LocalAddr().String() {
+		t.Errorf("accepted conn RemoteAddr = %v, want %v", addr, conn.LocalAddr())
+	}
+
+	bln.Close()
+	if _, err := bln.Accept(); err == nil {
+		t.Error("Accept after Close succeeded")
+	}
+}
+
+func TestServerBindACL(t *testing.T) {
+	// The default ACL denies the loopback addresses.
+	ln := startRelayServer(t, &Server{ACL: &ACL{}})
+	c := &Client{Addr: ln.Addr().String()}
+	_, err := c.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != StatusForbidden {
+		t.Errorf("Bind on loopback = %v, want status %#x", err, StatusForbidden)
+	}
+
+	// A fixed port must be listed in BindPorts.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(free.Addr().String())
+	free.Close()
+
+	ln = startRelayServer(t, &Server{})
+	c = &Client{Addr: ln.Addr().String()}
+	if _, err := c.Bind(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port)); !errors.As(err, &se) || se.Status != StatusForbidden {
+		t.Errorf("Bind on unlisted port %s = %v, want status %#x", port, err, StatusForbidden)
+	}
+
+	ln = startRelayServer(t, &Server{BindPorts: []string{port}})
+	c = &Client{Addr: ln.Addr().String()}
+	bln, err := c.Bind(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Bind on listed port %s: %v", port, err)
+	}
+	bln.Close()
+}
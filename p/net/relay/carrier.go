@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// relayProtocol is the protocol name of the WebSocket subprotocol and of the HTTP/2 extended CONNECT.
+const relayProtocol = "relay"
+
+// URL schemes of Client.Addr, selecting the carrier of the relay connections.
+const (
+	SchemeRelay    = "relay"     // plain TCP, or TLS if Client.TLSConfig is set
+	SchemeRelayTLS = "relay+tls" // TLS
+	SchemeWS       = "relay+ws"  // WebSocket
+	SchemeWSS      = "relay+wss" // WebSocket over TLS
+	SchemeH2       = "relay+h2"  // HTTP/2 extended CONNECT over TLS
+)
+
+// serverURL returns c.Addr as a URL, a host:port address is a relay:// URL.
+func (c *Client) serverURL() (*url.URL, error) {
+	if !strings.Contains(c.Addr, "://") {
+		return &url.URL{Scheme: SchemeRelay, Host: c.Addr}, nil
+	}
+	return url.Parse(c.Addr)
+}
+
+// dialServer connects to the relay server with the carrier selected by the scheme of c.Addr.
+func (c *Client) dialServer(ctx context.Context) (net.Conn, error) {
+	u, err := c.serverURL()
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case SchemeRelay:
+		if c.TLSConfig == nil {
+			return c.dialer().DialContext(ctx, "tcp", u.Host)
+		}
+		return c.dialTLS(ctx, u.Host)
+	case SchemeRelayTLS:
+		return c.dialTLS(ctx, u.Host)
+	case SchemeWS, SchemeWSS:
+		address := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == SchemeWSS {
+				port = "443"
+			}
+			address = net.JoinHostPort(u.Hostname(), port)
+		}
+		var conn net.Conn
+		if u.Scheme == SchemeWSS {
+			conn, err = c.dialTLS(ctx, address, "http/1.1")
+		} else {
+			conn, err = c.dialer().DialContext(ctx, "tcp", address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		wc, err := dialWebSocket(ctx, conn, u)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wc, nil
+	case SchemeH2:
+		return c.dialH2(ctx, u)
+	default:
+		return nil, fmt.Errorf("relay: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// dialTLS connects to address over TLS with c.TLSConfig, nextProtos are the ALPN protocols.
+func (c *Client) dialTLS(ctx context.Context, address string, nextProtos ...string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialer().DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := c.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if len(nextProtos) > 0 {
+		config.NextProtos = nextProtos
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// ServeHTTP serves a relay connection carried by an HTTP request, so the server can be mounted
+// on an http.Server: a WebSocket upgrade (RFC 6455) or an HTTP/2 extended CONNECT (RFC 8441)
+// for the "relay" protocol. Extended CONNECT requires the golang.org/x/net/http2 server,
+// see http2.ConfigureServer.
+//
+// The TLS state of the request, if any, authenticates the client certificate as in ServeConn.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var conn net.Conn
+	var err error
+	switch {
+	case r.Method == http.MethodConnect && r.ProtoMajor == 2:
+		conn, err = acceptH2(w, r)
+	case headerContains(r.Header, "Upgrade", "websocket"):
+		s.serveWebSocket(w, r)
+		return
+	default:
+		http.Error(w, "relay: websocket upgrade or HTTP/2 CONNECT required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("relay: %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	s.serveConn(conn, r.TLS)
+}
@@ -0,0 +1,95 @@
+package relay_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/w/net/http/httptest"
+)
+
+func relayURL(scheme, serverURL string) string {
+	_, hostport, _ := strings.Cut(serverURL, "://")
+	return scheme + "://" + hostport + "/relay"
+}
+
+func TestClientWebSocket(t *testing.T) {
+	echo := startEchoServer(t)
+	mux := http.NewServeMux()
+	mux.Handle("/relay", &Server{ACL: loopbackACL})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{Addr: relayURL(SchemeWS, ts.URL)}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+			t.Fatalf("Dial over websocket: %v", err)
+		}
+	}
+
+	// Requests are multiplexed over a single websocket.
+	c = &Client{Addr: relayURL(SchemeWS, ts.URL), Mux: true}
+	defer c.Close()
+	if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+		t.Fatalf("Dial over websocket mux: %v", err)
+	}
+
+	c = &Client{Addr: strings.Replace(relayURL(SchemeWS, ts.URL), "/relay", "/other", 1)}
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial to a path without relay handler succeeded")
+	}
+}
+
+func TestClientWebSocketTLS(t *testing.T) {
+	echo := startEchoServer(t)
+	ts := httptest.NewTLSServer(&Server{ACL: loopbackACL})
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	c := &Client{
+		Addr:      relayURL(SchemeWSS, ts.URL),
+		TLSConfig: &tls.Config{RootCAs: pool},
+	}
+	if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+		t.Fatalf("Dial over secure websocket: %v", err)
+	}
+}
+
+func TestClientH2(t *testing.T) {
+	echo := startEchoServer(t)
+	ts := httptest.NewUnstartedServer(&Server{ACL: loopbackACL})
+	ts.EnableHTTP2 = true
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatalf("ConfigureServer: %v", err)
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	c := &Client{
+		Addr:      relayURL(SchemeH2, ts.URL),
+		TLSConfig: &tls.Config{RootCAs: pool},
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+			t.Fatalf("Dial over h2: %v", err)
+		}
+	}
+}
+
+func TestClientUnsupportedScheme(t *testing.T) {
+	c := &Client{Addr: "relay+quic://127.0.0.1:1"}
+	if conn, err := c.Dial("tcp", "127.0.0.1:1"); err == nil {
+		conn.Close()
+		t.Fatal("Dial with an unsupported scheme succeeded")
+	}
+}
@@ -0,0 +1,55 @@
+package relay_test
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestParseChain(t *testing.T) {
+	echo := startEchoServer(t)
+	last := startRelayServer(t, &Server{Authenticator: StaticAuthenticator{"alice": "secret"}})
+
+	// The first server may only reach the last one.
+	_, port, _ := net.SplitHostPort(last.Addr().String())
+	acl, err := NewACL(Rule{Action: Allow, Hosts: []string{"127.0.0.1"}, Ports: []string{port}})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+	acl.DefaultDeny = true
+	first := startRelayServer(t, &Server{ACL: acl})
+
+	direct := &Client{Addr: first.Addr().String()}
+	if _, err := direct.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Fatal("Dial through the first hop only succeeded")
+	}
+
+	c, err := ParseChain(
+		first.Addr().String(),
+		"relay://"+url.UserPassword("alice", "secret").String()+"@"+last.Addr().String(),
+	)
+	if err != nil {
+		t.Fatalf("ParseChain: %v", err)
+	}
+	defer c.Close()
+	if c.Username != "alice" || c.Password != "secret" || c.Addr != "relay://"+last.Addr().String() {
+		t.Errorf("last hop = %q %q@%q", c.Username, c.Password, c.Addr)
+	}
+	if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseChainErrors(t *testing.T) {
+	for _, urls := range [][]string{
+		nil,
+		{"relay://"},
+		{"127.0.0.1:1", "relay://%zz"},
+	} {
+		if _, err := ParseChain(urls...); err == nil {
+			t.Errorf("ParseChain(%q) succeeded", urls)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/gptlocal/netool/p/net/mux"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Client dials targets through a relay server.
+//
+// Client implements Dialer, so it can be plugged into http.Transport.DialContext,
+// grpc.WithContextDialer and similar hooks.
+type Client struct {
+	// Addr is the TCP address of the relay server, or a URL whose scheme selects the carrier
+	// of the connections: relay://, relay+tls://, relay+ws://, relay+wss:// or relay+h2://.
+	Addr string
+
+	// Username and Password are sent to the server in a UserAuthFeature if Username is not empty.
+	Username string
+	Password string
+
+	// Version is the protocol version of the requests, Version1 if zero. If the server does not
+	// support it, the client retries once with the highest version supported by both sides.
+	Version uint8
+
+	// Tunnel is the tunnel to connect to or to register as a connector of.
+	// If zero, DialContext connects to the requested address directly.
+	Tunnel features.TunnelID
+
+	// Dialer connects to the relay server. If nil, a zero net.Dialer is used.
+	// Another Client reaches the server through a relay, see Chain.
+	Dialer Dialer
+
+	// TLSConfig, if not nil, secures the connection to the server with TLS, it also configures
+	// the TLS carriers. If ServerName is empty, the host of Addr is used. Set Certificates
+	// to authenticate with a client certificate.
+	TLSConfig *tls.Config
+
+	// Mux sends the requests over streams multiplexed on a single connection to the server,
+	// which saves the connection setup of every request. The connection is established
+	// on first use and re-established once closed, Close closes it.
+	Mux bool
+
+	mu   sync.Mutex // protects sess
+	sess *mux.Session
+
+	h2mu sync.Mutex // protects h2
+	h2   *http2.Transport
+}
+
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the named network through the relay server.
+// For UDP networks, the returned connection also implements net.PacketConn.
+// If c.Tunnel is set, the connection is routed to a connector of that tunnel.
+//
+// The context covers both connecting to the relay server and the relay handshake,
+// once the connection is established, expiration of the context has no effect on it.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	cmd := CmdConnect
+	var nid features.NetworkID
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		nid = features.NetworkTCP
+	case "udp", "udp4", "udp6":
+		cmd |= FUDP
+		nid = features.NetworkUDP
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	af := &features.AddrFeature{}
+	if err := af.ParseFrom(address); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	req := c.newRequest(cmd, af, &features.NetworkFeature{Network: nid})
+	if !c.Tunnel.IsZero() {
+		req.Features = append(req.Features, &features.TunnelFeature{ID: c.Tunnel.ID(), Flag: uint32(c.Tunnel.Flag())})
+	}
+
+	conn, _, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if nid == features.NetworkUDP {
+		return &packetConn{
+			Conn:  conn,
+			laddr: &Addr{Net: network, Address: conn.LocalAddr().String()},
+			raddr: &Addr{Net: network, Address: address},
+		}, nil
+	}
+	return conn, nil
+}
+
+// Bind asks the relay server to listen on address, the returned listener accepts the
+// connections received by the server, each of them is carried by a stream multiplexed
+// over the connection to the server.
+//
+// The context only covers the BIND handshake.
+func (c *Client) Bind(ctx context.Context, network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	af := &features.AddrFeature{}
+	if err := af.ParseFrom(address); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	req := c.newRequest(CmdBind, af, &features.NetworkFeature{Network: features.NetworkTCP})
+
+	conn, resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	ln := &bindListener{
+		sess: mux.Client(conn, nil),
+		addr: &Addr{Net: network, Address: address},
+	}
+	for _, f := range resp.Features {
+		if f, ok := f.(*features.AddrFeature); ok {
+			ln.addr.Address = f.String()
+		}
+	}
+	return ln, nil
+}
+
+func (c *Client) newRequest(cmd CmdType, fs ...features.Feature) *Request {
+	req := &Request{
+		Version: c.Version,
+		Cmd:     cmd,
+	}
+	if req.Version == 0 {
+		req.Version = Version1
+	}
+	if c.Username != "" {
+		req.Features = append(req.Features, &features.UserAuthFeature{
+			Username: c.Username,
+			Password: c.Password,
+		})
+	}
+	req.Features = append(req.Features, fs...)
+	return req
+}
+
+// roundTrip connects to the relay server and sends req, it returns the connection
+// and the response if the server accepted the request.
+//
+// If the server rejects the protocol version of req, the request is sent again on a new
+// connection with the highest version advertised by the server and known by the client.
+func (c *Client) roundTrip(ctx context.Context, req *Request) (net.Conn, *Response, error) {
+	conn, resp, err := c.exchange(ctx, req)
+	var se *StatusError
+	if errors.As(err, &se) && se.Status == StatusUnsupportedVersion {
+		if v := negotiateVersion(resp); v != 0 && v != req.Version {
+			req.Version = v
+			return c.exchange(ctx, req)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, resp, nil
+}
+
+func (c *Client) exchange(ctx context.Context, req *Request) (net.Conn, *Response, error) {
+	var conn net.Conn
+	var err error
+	if c.Mux && req.Cmd&CmdMask != CmdMux {
+		conn, err = c.openStream(ctx)
+	} else {
+		conn, err = c.dialServer(ctx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.handshake(ctx, conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	return conn, resp, nil
+}
+
+// negotiateVersion returns the preferred version among the ones advertised in resp,
+// or zero if there is none in common.
+func negotiateVersion(resp *Response) uint8 {
+	if resp == nil {
+		return 0
+	}
+	for _, f := range resp.Features {
+		vf, ok := f.(*features.VersionFeature)
+		if !ok {
+			continue
+		}
+		for _, v := range supportedVersions {
+			for _, sv := range vf.Versions {
+				if v == sv {
+					return v
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// handshake writes req to conn and reads the response, the request is aborted when ctx is done.
+func (c *Client) handshake(ctx context.Context, conn net.Conn, req *Request) (resp *Response, err error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() {
+			// The context expired during the handshake and the deadline has been poisoned.
+			err = ctx.Err()
+		}
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	if _, err = req.WriteTo(conn); err != nil {
+		return
+	}
+	resp = &Response{}
+	if _, err = resp.ReadFrom(conn); err != nil {
+		return
+	}
+	if resp.Status != StatusOK {
+		err = &StatusError{Status: resp.Status}
+	}
+	return
+}
+
+func (c *Client) dialer() Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return &net.Dialer{}
+}
@@ -0,0 +1,107 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestClientDial(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+
+	c := &Client{Addr: ln.Addr().String()}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello relay client")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+}
+
+func TestClientDialUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+	if conn, err := c.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("Dial to closed port succeeded")
+	}
+}
+
+func TestClientDialContextCancel(t *testing.T) {
+	// A server that accepts connections but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := &Client{Addr: ln.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = c.DialContext(ctx, "tcp", "example.com:80")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("DialContext took %v after context expiration", d)
+	}
+}
+
+func TestClientHTTPTransport(t *testing.T) {
+	hln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})}
+	go hs.Serve(hln)
+	defer hs.Close()
+
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+	hc := &http.Client{Transport: &http.Transport{DialContext: c.DialContext}}
+	defer hc.CloseIdleConnections()
+
+	resp, err := hc.Get("http://" + hln.Addr().String())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "ok" {
+		t.Errorf("body = %q, want %q", b, "ok")
+	}
+}
@@ -30,6 +30,7 @@ const (
 //	ADDR - host address, IPv4 (4 bytes), IPV6 (16 bytes) or doman name based on ATYP. For domain name, the first byte is the length of the domain name.
 //	PORT - port number, 2 bytes.
 type AddrFeature struct {
+	FeatureFlags
 	AType AddrType
 	Host  string
 	Port  uint16
@@ -101,38 +102,52 @@ func (f *AddrFeature) Encode() ([]byte, error) {
 }
 
 func (f *AddrFeature) Decode(b []byte) error {
-	if len(b) < 4 {
+	if len(b) < 1 {
 		return ErrShortBuffer
 	}
 
-	f.AType = AddrType(b[0])
+	var host string
+	atype := AddrType(b[0])
 	pos := 1
-	switch f.AType {
+	switch atype {
 	case AddrIPv4:
-		if len(b) < 3+net.IPv4len {
+		if len(b) < pos+net.IPv4len+2 {
 			return ErrShortBuffer
 		}
-		f.Host = net.IP(b[pos : pos+net.IPv4len]).String()
+		host = net.IP(b[pos : pos+net.IPv4len]).String()
 		pos += net.IPv4len
 	case AddrIPv6:
-		if len(b) < 3+net.IPv6len {
+		if len(b) < pos+net.IPv6len+2 {
 			return ErrShortBuffer
 		}
-		f.Host = net.IP(b[pos : pos+net.IPv6len]).String()
+		host = net.IP(b[pos : pos+net.IPv6len]).String()
 		pos += net.IPv6len
 	case AddrDomain:
-		alen := int(b[pos])
-		if len(b) < 4+alen {
+		if len(b) < pos+1 {
 			return ErrShortBuffer
 		}
+		alen := int(b[pos])
 		pos++
-		f.Host = string(b[pos : pos+alen])
+		if len(b) < pos+alen+2 {
+			return ErrShortBuffer
+		}
+		host = string(b[pos : pos+alen])
 		pos += alen
 	default:
 		return ErrBadAddrType
 	}
+	if len(b) != pos+2 {
+		return ErrTrailingData
+	}
 
+	f.AType = atype
+	f.Host = host
 	f.Port = binary.BigEndian.Uint16(b[pos:])
 
 	return nil
 }
+
+// String returns the address in host:port form.
+func (f *AddrFeature) String() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(int(f.Port)))
+}
@@ -3,16 +3,21 @@ package features
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 )
 
 var (
-	ErrShortBuffer = errors.New("short buffer")
-	ErrBadAddrType = errors.New("bad address type")
+	ErrShortBuffer         = errors.New("short buffer")
+	ErrBadAddrType         = errors.New("bad address type")
+	ErrUnsupportedCritical = errors.New("unsupported critical feature")
+	ErrTrailingData        = errors.New("trailing data")
 )
 
 const (
-	featureHeaderLen = 3
+	featureHeaderLen   = 3
+	featureHeaderLenV2 = 4
 )
 
 type FeatureType uint8
@@ -22,8 +27,40 @@ const (
 	FeatureAddr     FeatureType = 0x02
 	FeatureTunnel   FeatureType = 0x03
 	FeatureNetwork  FeatureType = 0x04
+	FeatureVersion  FeatureType = 0x05
 )
 
+// FeatureFlag is the per-feature flag of the Version2 wire format.
+type FeatureFlag uint8
+
+const (
+	// FlagCritical marks a feature that must be understood by the receiver,
+	// a message carrying an unknown critical feature is rejected.
+	// Features without this flag are optional and kept as UnknownFeature if unknown.
+	FlagCritical FeatureFlag = 0x01
+)
+
+// FlaggedFeature is implemented by the features which carry flags in the Version2 wire format.
+type FlaggedFeature interface {
+	Feature
+	Flags() FeatureFlag
+	SetFlags(FeatureFlag)
+}
+
+// FeatureFlags keeps the flags of a feature in the Version2 wire format. The known features
+// embed it, so their flags survive a decode and re-encode.
+type FeatureFlags struct {
+	flag FeatureFlag
+}
+
+func (f *FeatureFlags) Flags() FeatureFlag {
+	return f.flag
+}
+
+func (f *FeatureFlags) SetFlags(flag FeatureFlag) {
+	f.flag = flag
+}
+
 // Feature represents a feature the client or server owned.
 //
 // Protocol spec:
@@ -55,19 +92,121 @@ func ReadFeature(r io.Reader) (Feature, error) {
 	return NewFeature(FeatureType(header[0]), b)
 }
 
+var (
+	registryMu sync.RWMutex
+	registry   = map[FeatureType]func() Feature{
+		FeatureUserAuth: func() Feature { return new(UserAuthFeature) },
+		FeatureAddr:     func() Feature { return new(AddrFeature) },
+		FeatureTunnel:   func() Feature { return new(TunnelFeature) },
+		FeatureNetwork:  func() Feature { return new(NetworkFeature) },
+		FeatureVersion:  func() Feature { return new(VersionFeature) },
+	}
+)
+
+// RegisterFeature makes the feature type t decodable by NewFeature and ReadFeature,
+// fn returns a new zero value of the feature. Features that embed FeatureFlags keep their
+// flags when read by ReadFeatureV2.
+// It panics if fn is nil or if t is already registered.
+func RegisterFeature(t FeatureType, fn func() Feature) {
+	if fn == nil {
+		panic("features: RegisterFeature with nil func")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[t]; dup {
+		panic(fmt.Sprintf("features: RegisterFeature called twice for type %#x", uint8(t)))
+	}
+	registry[t] = fn
+}
+
+// ReadFeatureV2 reads a feature in the Version2 wire format.
+//
+// Protocol spec:
+//
+//	+------+-------+-------+---------+
+//	| TYPE | FLAGS |  LEN  | FEATURE |
+//	+------+-------+-------+---------+
+//	|  1   |   1   |   2   |   VAR   |
+//	+------+-------+-------+---------+
+//
+//	TYPE - feature type, 1 byte.
+//	FLAGS - feature flags, 1 byte.
+//	LEN - length of feature data, 2 bytes.
+//	FEATURE - feature data.
+func ReadFeatureV2(r io.Reader) (Feature, error) {
+	var header [featureHeaderLenV2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, int(binary.BigEndian.Uint16(header[2:4])))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	f, err := NewFeature(FeatureType(header[0]), b)
+	if err != nil {
+		return nil, err
+	}
+	flag := FeatureFlag(header[1])
+	if uf, ok := f.(*UnknownFeature); ok && flag&FlagCritical != 0 {
+		return nil, fmt.Errorf("%w: type %#x", ErrUnsupportedCritical, uint8(uf.FeatureType))
+	}
+	if ff, ok := f.(FlaggedFeature); ok {
+		ff.SetFlags(flag)
+	}
+	return f, nil
+}
+
+// FlagsOf returns the flags of f, or zero if f carries no flags.
+func FlagsOf(f Feature) FeatureFlag {
+	if ff, ok := f.(FlaggedFeature); ok {
+		return ff.Flags()
+	}
+	return 0
+}
+
+// NewFeature decodes data as a feature of type t. Features of an unregistered type are
+// decoded as UnknownFeature.
 func NewFeature(t FeatureType, data []byte) (f Feature, err error) {
-	switch t {
-	case FeatureUserAuth:
-		f = new(UserAuthFeature)
-	case FeatureAddr:
-		f = new(AddrFeature)
-	case FeatureTunnel:
-		f = new(TunnelFeature)
-	case FeatureNetwork:
-		f = new(NetworkFeature)
-	default:
-		return nil, errors.New("unknown feature")
+	registryMu.RLock()
+	fn := registry[t]
+	registryMu.RUnlock()
+
+	if fn != nil {
+		f = fn()
+	} else {
+		f = &UnknownFeature{FeatureType: t}
 	}
 	err = f.Decode(data)
 	return
 }
+
+// UnknownFeature is a feature of a type this peer does not know about. It keeps the raw
+// feature data, so the feature survives a decode and re-encode unchanged.
+type UnknownFeature struct {
+	FeatureType FeatureType
+	Flag        FeatureFlag // flags received in the Version2 wire format
+	Data        []byte
+}
+
+func (f *UnknownFeature) Type() FeatureType {
+	return f.FeatureType
+}
+
+func (f *UnknownFeature) Flags() FeatureFlag {
+	return f.Flag
+}
+
+func (f *UnknownFeature) SetFlags(flag FeatureFlag) {
+	f.Flag = flag
+}
+
+func (f *UnknownFeature) Encode() ([]byte, error) {
+	return f.Data, nil
+}
+
+func (f *UnknownFeature) Decode(b []byte) error {
+	f.Data = append(f.Data[:0], b...)
+	return nil
+}
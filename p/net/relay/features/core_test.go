@@ -0,0 +1,80 @@
+package features_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay/features"
+)
+
+const featureTimestamp FeatureType = 0x70
+
+type timestampFeature struct {
+	Unix uint64
+}
+
+func (f *timestampFeature) Type() FeatureType {
+	return featureTimestamp
+}
+
+func (f *timestampFeature) Encode() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, f.Unix), nil
+}
+
+func (f *timestampFeature) Decode(b []byte) error {
+	if len(b) < 8 {
+		return ErrShortBuffer
+	}
+	f.Unix = binary.BigEndian.Uint64(b)
+	return nil
+}
+
+func init() {
+	RegisterFeature(featureTimestamp, func() Feature { return new(timestampFeature) })
+}
+
+func TestRegisterFeature(t *testing.T) {
+	f, err := NewFeature(featureTimestamp, []byte{0, 0, 0, 0, 0x65, 0x4b, 0x6e, 0x00})
+	if err != nil {
+		t.Fatalf("NewFeature: %v", err)
+	}
+	ts, ok := f.(*timestampFeature)
+	if !ok {
+		t.Fatalf("NewFeature returned %T, want *timestampFeature", f)
+	}
+	if ts.Unix != 0x654b6e00 {
+		t.Errorf("Unix = %#x, want %#x", ts.Unix, 0x654b6e00)
+	}
+}
+
+func TestRegisterFeatureDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering FeatureAddr twice did not panic")
+		}
+	}()
+	RegisterFeature(FeatureAddr, func() Feature { return new(AddrFeature) })
+}
+
+func TestUnknownFeatureRoundTrip(t *testing.T) {
+	raw := []byte{0x7f, 0x00, 0x03, 'a', 'b', 'c'}
+	f, err := ReadFeature(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadFeature: %v", err)
+	}
+	uf, ok := f.(*UnknownFeature)
+	if !ok {
+		t.Fatalf("ReadFeature returned %T, want *UnknownFeature", f)
+	}
+	if uf.Type() != 0x7f {
+		t.Errorf("Type() = %#x, want %#x", uf.Type(), 0x7f)
+	}
+	b, err := uf.Encode()
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if !bytes.Equal(b, raw[3:]) {
+		t.Errorf("Encode() = %q, want %q", b, raw[3:])
+	}
+}
@@ -0,0 +1,102 @@
+package features_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay/features"
+)
+
+// checkRoundTrip decodes b with a new feature from fn, re-encodes it and checks
+// that the encoding decodes to the same feature.
+func checkRoundTrip(t *testing.T, fn func() Feature, b []byte) {
+	f := fn()
+	if err := f.Decode(b); err != nil {
+		return
+	}
+	enc, err := f.Encode()
+	if err != nil {
+		t.Fatalf("Encode(%#v): %v", f, err)
+	}
+	f2 := fn()
+	if err := f2.Decode(enc); err != nil {
+		t.Fatalf("Decode(%x) of re-encoded %x: %v", enc, b, err)
+	}
+	if !reflect.DeepEqual(f, f2) {
+		t.Fatalf("round trip of %x: got %#v, want %#v", b, f2, f)
+	}
+}
+
+func FuzzAddrFeature(f *testing.F) {
+	f.Add([]byte{byte(AddrIPv4), 127, 0, 0, 1, 0x1f, 0x90})
+	f.Add([]byte{byte(AddrIPv6), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80})
+	f.Add([]byte{byte(AddrDomain), 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	f.Add([]byte{byte(AddrDomain), 0, 0, 0})
+	f.Add([]byte{byte(AddrDomain), 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRoundTrip(t, func() Feature { return new(AddrFeature) }, b)
+	})
+}
+
+func FuzzUserAuthFeature(f *testing.F) {
+	f.Add([]byte{4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	f.Add([]byte{0, 0})
+	f.Add([]byte{5, 'u'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRoundTrip(t, func() Feature { return new(UserAuthFeature) }, b)
+	})
+}
+
+func FuzzTunnelFeature(f *testing.F) {
+	f.Add(make([]byte, 16))
+	f.Add(append(make([]byte, 16), 0, 0, 0, 1))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRoundTrip(t, func() Feature { return new(TunnelFeature) }, b)
+	})
+}
+
+func FuzzNetworkFeature(f *testing.F) {
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRoundTrip(t, func() Feature { return new(NetworkFeature) }, b)
+	})
+}
+
+func FuzzVersionFeature(f *testing.F) {
+	f.Add([]byte{2, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRoundTrip(t, func() Feature { return new(VersionFeature) }, b)
+	})
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		f    Feature
+		b    []byte
+		err  error
+	}{
+		{"addr empty", new(AddrFeature), nil, ErrShortBuffer},
+		{"addr bad type", new(AddrFeature), []byte{0x09, 0, 0}, ErrBadAddrType},
+		{"addr short ipv4", new(AddrFeature), []byte{byte(AddrIPv4), 127, 0, 0, 1, 0}, ErrShortBuffer},
+		{"addr ipv4 trailing", new(AddrFeature), []byte{byte(AddrIPv4), 127, 0, 0, 1, 0, 80, 0}, ErrTrailingData},
+		{"addr domain no length", new(AddrFeature), []byte{byte(AddrDomain)}, ErrShortBuffer},
+		{"addr domain no port", new(AddrFeature), []byte{byte(AddrDomain), 1, 'a'}, ErrShortBuffer},
+		{"addr domain trailing", new(AddrFeature), []byte{byte(AddrDomain), 1, 'a', 0, 80, 'x'}, ErrTrailingData},
+		{"user auth short", new(UserAuthFeature), []byte{4, 'u', 's'}, ErrShortBuffer},
+		{"user auth no password", new(UserAuthFeature), []byte{4, 'u', 's', 'e', 'r'}, ErrShortBuffer},
+		{"user auth trailing", new(UserAuthFeature), []byte{1, 'u', 1, 'p', 'x'}, ErrTrailingData},
+		{"network trailing", new(NetworkFeature), []byte{0, 1, 0}, ErrTrailingData},
+		{"tunnel short", new(TunnelFeature), make([]byte, 15), ErrShortBuffer},
+		{"tunnel partial flag", new(TunnelFeature), make([]byte, 18), ErrTrailingData},
+		{"tunnel trailing", new(TunnelFeature), make([]byte, 21), ErrTrailingData},
+		{"version empty", new(VersionFeature), nil, ErrShortBuffer},
+	}
+	for _, tt := range tests {
+		if err := tt.f.Decode(tt.b); !errors.Is(err, tt.err) {
+			t.Errorf("%s: Decode(%x) = %v, want %v", tt.name, tt.b, err, tt.err)
+		}
+	}
+}
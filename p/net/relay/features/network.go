@@ -44,6 +44,7 @@ var networkNames = map[NetworkID]string{
 //
 //	NETWORK - 2-byte network ID.
 type NetworkFeature struct {
+	FeatureFlags
 	Network NetworkID
 }
 
@@ -61,6 +62,9 @@ func (f *NetworkFeature) Decode(b []byte) error {
 	if len(b) < networkIDLen {
 		return ErrShortBuffer
 	}
+	if len(b) > networkIDLen {
+		return ErrTrailingData
+	}
 	f.Network = NetworkID(binary.BigEndian.Uint16(b))
 	return nil
 }
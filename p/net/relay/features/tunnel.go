@@ -52,6 +52,11 @@ func (tid TunnelID) IsPrivate() bool {
 	return binary.BigEndian.Uint32(tid[tunnelIDLen:])&uint32(TunnelPrivate) > 0
 }
 
+// Flag returns the tunnel flag.
+func (tid TunnelID) Flag() TunnelFlag {
+	return TunnelFlag(binary.BigEndian.Uint32(tid[tunnelIDLen:]))
+}
+
 func (tid TunnelID) Equal(x TunnelID) bool {
 	return bytes.Equal(tid[:tunnelIDLen], x[:tunnelIDLen])
 }
@@ -120,6 +125,11 @@ func (cid ConnectorID) IsUDP() bool {
 	return binary.BigEndian.Uint32(cid[connectorIDLen:])&uint32(ConnectorUDP) > 0
 }
 
+// Flag returns the connector flag.
+func (cid ConnectorID) Flag() ConnectorFlag {
+	return ConnectorFlag(binary.BigEndian.Uint32(cid[connectorIDLen:]))
+}
+
 func (cid ConnectorID) Equal(x ConnectorID) bool {
 	return bytes.Equal(cid[:connectorIDLen], x[:connectorIDLen])
 }
@@ -134,31 +144,60 @@ func (cid ConnectorID) String() string {
 //
 // Protocol spec:
 //
-//	+---------------------+
-//	| TUNNEL/CONNECTOR ID |
-//	+---------------------+
-//	|          16         |
-//	+---------------------+
+//	+---------------------+--------+
+//	| TUNNEL/CONNECTOR ID |  FLAG  |
+//	+---------------------+--------+
+//	|          16         |   4    |
+//	+---------------------+--------+
 //
 //	ID - 16-byte tunnel ID for request or connector ID for response.
+//	FLAG - optional 4-byte tunnel flag for request or connector flag for response, omitted if zero.
 type TunnelFeature struct {
-	ID [tunnelIDLen]byte
+	FeatureFlags
+	ID   [tunnelIDLen]byte
+	Flag uint32
 }
 
 func (f *TunnelFeature) Type() FeatureType {
 	return FeatureTunnel
 }
 
+// TunnelID returns the tunnel ID carried by a request.
+func (f *TunnelFeature) TunnelID() (tid TunnelID) {
+	copy(tid[:tunnelIDLen], f.ID[:])
+	binary.BigEndian.PutUint32(tid[tunnelIDLen:], f.Flag)
+	return
+}
+
+// ConnectorID returns the connector ID carried by a response.
+func (f *TunnelFeature) ConnectorID() (cid ConnectorID) {
+	copy(cid[:connectorIDLen], f.ID[:])
+	binary.BigEndian.PutUint32(cid[connectorIDLen:], f.Flag)
+	return
+}
+
 func (f *TunnelFeature) Encode() ([]byte, error) {
 	var buf bytes.Buffer
 	buf.Write(f.ID[:])
+	if f.Flag != 0 {
+		binary.Write(&buf, binary.BigEndian, f.Flag)
+	}
 	return buf.Bytes(), nil
 }
 
 func (f *TunnelFeature) Decode(b []byte) error {
-	if len(b) < tunnelIDLen {
-		return ErrShortBuffer
+	switch len(b) {
+	case tunnelIDLen:
+		copy(f.ID[:], b)
+		f.Flag = 0
+	case tunnelIDLen + 4:
+		copy(f.ID[:], b)
+		f.Flag = binary.BigEndian.Uint32(b[tunnelIDLen:])
+	default:
+		if len(b) < tunnelIDLen {
+			return ErrShortBuffer
+		}
+		return ErrTrailingData
 	}
-	copy(f.ID[:], b)
 	return nil
 }
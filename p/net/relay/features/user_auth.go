@@ -21,6 +21,7 @@ import (
 //	PLEN - length of password field, 1 byte.
 //	PASSWD - password, variable length, 0 to 255 bytes, 0 means no password.
 type UserAuthFeature struct {
+	FeatureFlags
 	Username string
 	Password string
 }
@@ -61,7 +62,7 @@ func (f *UserAuthFeature) Decode(b []byte) error {
 	if len(b) < pos+ulen+1 {
 		return ErrShortBuffer
 	}
-	f.Username = string(b[pos : pos+ulen])
+	username := string(b[pos : pos+ulen])
 
 	pos += ulen
 	plen := int(b[pos])
@@ -70,6 +71,11 @@ func (f *UserAuthFeature) Decode(b []byte) error {
 	if len(b) < pos+plen {
 		return ErrShortBuffer
 	}
+	if len(b) > pos+plen {
+		return ErrTrailingData
+	}
+
+	f.Username = username
 	f.Password = string(b[pos : pos+plen])
 
 	return nil
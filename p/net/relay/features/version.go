@@ -0,0 +1,33 @@
+package features
+
+// VersionFeature is a relay feature, it advertises the protocol versions supported by the sender.
+//
+// Protocol spec:
+//
+//	+-----+-----+-----+
+//	| VER | ... | VER |
+//	+-----+-----+-----+
+//	|  1  |     |  1  |
+//	+-----+-----+-----+
+//
+//	VER - a supported protocol version, 1 byte each.
+type VersionFeature struct {
+	FeatureFlags
+	Versions []uint8
+}
+
+func (f *VersionFeature) Type() FeatureType {
+	return FeatureVersion
+}
+
+func (f *VersionFeature) Encode() ([]byte, error) {
+	return append([]byte(nil), f.Versions...), nil
+}
+
+func (f *VersionFeature) Decode(b []byte) error {
+	if len(b) < 1 {
+		return ErrShortBuffer
+	}
+	f.Versions = append(f.Versions[:0], b...)
+	return nil
+}
@@ -0,0 +1,149 @@
+package relay_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+func requestSeeds() []*Request {
+	af := &features.AddrFeature{}
+	af.ParseFrom("example.com:443")
+	return []*Request{
+		{Version: Version1, Cmd: CmdConnect, Features: []features.Feature{af}},
+		{Version: Version1, Cmd: CmdConnect | FUDP, Features: []features.Feature{
+			&features.UserAuthFeature{Username: "user", Password: "pass"},
+			af,
+			&features.NetworkFeature{Network: features.NetworkUDP},
+		}},
+		{Version: Version2, Cmd: CmdBind, Features: []features.Feature{
+			&features.TunnelFeature{Flag: 1},
+			&features.UnknownFeature{FeatureType: 0x7f, Data: []byte{1, 2, 3}},
+		}},
+	}
+}
+
+func FuzzRequest(f *testing.F) {
+	for _, req := range requestSeeds() {
+		var buf bytes.Buffer
+		req.WriteTo(&buf)
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{Version1, byte(CmdConnect), 0, 3, byte(features.FeatureAddr), 0xff, 0xff})
+	f.Add([]byte{Version2, byte(CmdConnect), 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req := &Request{}
+		if _, err := req.ReadFrom(bytes.NewReader(b)); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := req.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo(%#v): %v", req, err)
+		}
+		req2 := &Request{}
+		if _, err := req2.ReadFrom(&buf); err != nil {
+			t.Fatalf("ReadFrom of re-encoded %x: %v", b, err)
+		}
+		if !reflect.DeepEqual(req, req2) {
+			t.Fatalf("round trip of %x: got %#v, want %#v", b, req2, req)
+		}
+	})
+}
+
+func FuzzResponse(f *testing.F) {
+	af := &features.AddrFeature{}
+	af.ParseFrom("[::1]:8080")
+	for _, resp := range []*Response{
+		{Version: Version1, Status: StatusOK, Features: []features.Feature{af}},
+		{Version: Version1, Status: StatusUnsupportedVersion, Features: []features.Feature{&features.VersionFeature{Versions: []uint8{Version2, Version1}}}},
+		{Version: Version2, Status: StatusForbidden},
+	} {
+		var buf bytes.Buffer
+		resp.WriteTo(&buf)
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp := &Response{}
+		if _, err := resp.ReadFrom(bytes.NewReader(b)); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := resp.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo(%#v): %v", resp, err)
+		}
+		resp2 := &Response{}
+		if _, err := resp2.ReadFrom(&buf); err != nil {
+			t.Fatalf("ReadFrom of re-encoded %x: %v", b, err)
+		}
+		if !reflect.DeepEqual(resp, resp2) {
+			t.Fatalf("round trip of %x: got %#v, want %#v", b, resp2, resp)
+		}
+	})
+}
+
+func FuzzDatagram(f *testing.F) {
+	dgram := &Datagram{Data: []byte("ping")}
+	dgram.Addr.ParseFrom("127.0.0.1:53")
+	var buf bytes.Buffer
+	dgram.WriteTo(&buf)
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 0, 0})
+	f.Add([]byte{0, 1, 7, byte(features.AddrIPv4), 1, 2, 3, 4, 0, 53, 'x'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d := &Datagram{}
+		if _, err := d.ReadFrom(bytes.NewReader(b)); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := d.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo(%#v): %v", d, err)
+		}
+		d2 := &Datagram{}
+		if _, err := d2.ReadFrom(&buf); err != nil {
+			t.Fatalf("ReadFrom of re-encoded %x: %v", b, err)
+		}
+		if !reflect.DeepEqual(d, d2) {
+			t.Fatalf("round trip of %x: got %#v, want %#v", b, d2, d)
+		}
+	})
+}
+
+func TestRequestTooManyFeatures(t *testing.T) {
+	fs := make([]features.Feature, 65)
+	for i := range fs {
+		fs[i] = &features.NetworkFeature{Network: features.NetworkTCP}
+	}
+
+	var buf bytes.Buffer
+	req := &Request{Version: Version1, Cmd: CmdConnect, Features: fs}
+	if _, err := req.WriteTo(&buf); !errors.Is(err, ErrTooManyFeatures) {
+		t.Errorf("WriteTo = %v, want %v", err, ErrTooManyFeatures)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{Version1, byte(CmdConnect), 65 * 5 >> 8, 65 * 5 & 0xff})
+	for range fs {
+		buf.Write([]byte{byte(features.FeatureNetwork), 0, 2, 0, 0})
+	}
+	if _, err := req.ReadFrom(&buf); !errors.Is(err, ErrTooManyFeatures) {
+		t.Errorf("ReadFrom = %v, want %v", err, ErrTooManyFeatures)
+	}
+}
+
+func TestRequestTruncatedFeature(t *testing.T) {
+	b := []byte{Version1, byte(CmdConnect), 0, 3, byte(features.FeatureAddr), 0, 7}
+	req := &Request{}
+	if _, err := req.ReadFrom(bytes.NewReader(b)); err == nil {
+		t.Fatalf("ReadFrom(%x) succeeded", b)
+	}
+	if req.Features != nil {
+		t.Errorf("req.Features = %v after a decoding error", req.Features)
+	}
+}
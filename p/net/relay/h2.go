@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	wnet "github.com/gptlocal/netool/w/net"
+)
+
+// streamConn is a net.Conn carried by an HTTP/2 stream. The stream is pumped through a pipe,
+// which provides the deadlines the request and response bodies lack.
+type streamConn struct {
+	net.Conn // local end of the pipe
+	laddr    net.Addr
+	raddr    net.Addr
+
+	closeStream func()
+	done        chan struct{}
+}
+
+// newStreamConn pumps the data read from body to the returned conn and the data written
+// to the conn to w, flush is called after every write if not nil. closeStream is called
+// once the conn is closed or the stream is finished.
+func newStreamConn(body io.ReadCloser, w io.Writer, flush func(), closeStream func(), laddr, raddr net.Addr) *streamConn {
+	c1, c2 := wnet.Pipe()
+	var once sync.Once
+	c := &streamConn{
+		Conn:        c1,
+		laddr:       laddr,
+		raddr:       raddr,
+		closeStream: func() { once.Do(closeStream) },
+		done:        make(chan struct{}),
+	}
+
+	go func() {
+		defer close(c.done)
+
+		rdone := make(chan struct{})
+		go func() {
+			defer close(rdone)
+			io.Copy(c2, body)
+			c2.Close()
+		}()
+
+		b := netutil.GetBuffer()
+		defer netutil.PutBuffer(b)
+		for {
+			n, err := c2.Read(b)
+			if n > 0 {
+				if _, err := w.Write(b[:n]); err != nil {
+					break
+				}
+				if flush != nil {
+					flush()
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		c2.Close()
+		body.Close()
+		c.closeStream()
+		<-rdone
+	}()
+	return c
+}
+
+// Close closes the conn and waits for the stream to be released.
+func (c *streamConn) Close() error {
+	err := c.Conn.Close()
+	c.closeStream()
+	<-c.done
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// acceptH2 answers an HTTP/2 extended CONNECT request for the relay protocol. The returned
+// conn must be closed before the handler returns.
+func acceptH2(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if p := r.Header.Get(":protocol"); p != relayProtocol {
+		http.Error(w, "relay: unsupported protocol", http.StatusBadRequest)
+		return nil, fmt.Errorf("h2: unsupported protocol %q", p)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, errors.New("h2: response cannot be flushed")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var laddr net.Addr = &Addr{Net: "tcp"}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		laddr = addr
+	}
+	raddr := &Addr{Net: "tcp", Address: r.RemoteAddr}
+	return newStreamConn(r.Body, w, flusher.Flush, func() {}, laddr, raddr), nil
+}
+
+// dialH2 opens an HTTP/2 extended CONNECT stream (RFC 8441) for the relay protocol to u,
+// the request is aborted when ctx is done.
+func (c *Client) dialH2(ctx context.Context, u *url.URL) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	// The stream outlives ctx, it is only bound to ctx until the response is received.
+	sctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	req, err := http.NewRequestWithContext(sctx, http.MethodConnect, target.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set(":protocol", relayProtocol)
+
+	resp, err := c.h2Transport().RoundTrip(req)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("h2: unexpected response %s", resp.Status)
+	}
+
+	closeStream := func() {
+		pw.Close()
+		cancel()
+	}
+	return newStreamConn(resp.Body, pw, nil, closeStream, &Addr{Net: "tcp"}, &Addr{Net: "tcp", Address: u.Host}), nil
+}
+
+func (c *Client) h2Transport() *http2.Transport {
+	c.h2mu.Lock()
+	defer c.h2mu.Unlock()
+
+	if c.h2 == nil {
+		c.h2 = &http2.Transport{
+			TLSClientConfig: c.TLSConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := c.dialer().DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tc := tls.Client(conn, cfg)
+				if err := tc.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+		}
+	}
+	return c.h2
+}
@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// handshakeBuckets are the upper bounds in seconds of the handshake latency histogram.
+var handshakeBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects the counters of a relay server, a zero Metrics is ready to use.
+// It serves them over HTTP in the Prometheus text format.
+//
+// A session is a CONNECT, BIND or ASSOCIATE request, whether on a connection of its own
+// or on a mux session.
+type Metrics struct {
+	active atomic.Int64
+
+	mu         sync.Mutex
+	sessions   map[sessionKey]uint64
+	users      map[string]*userBytes
+	dialErrors map[uint8]uint64
+	handshake  []uint64 // per bucket of handshakeBuckets, not cumulative, plus +Inf
+	latencySum float64
+	latencyN   uint64
+}
+
+type sessionKey struct {
+	cmd    CmdType
+	status uint8
+}
+
+// userBytes counts the bytes relayed for a user, from the client (in) and to the client (out).
+type userBytes struct {
+	in, out atomic.Uint64
+}
+
+func (m *Metrics) userBytes(user string) *userBytes {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users == nil {
+		m.users = make(map[string]*userBytes)
+	}
+	ub := m.users[user]
+	if ub == nil {
+		ub = &userBytes{}
+		m.users[user] = ub
+	}
+	return ub
+}
+
+func (m *Metrics) observeHandshake(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handshake == nil {
+		m.handshake = make([]uint64, len(handshakeBuckets)+1)
+	}
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(handshakeBuckets, sec)
+	m.handshake[i]++
+	m.latencySum += sec
+	m.latencyN++
+}
+
+func (m *Metrics) endSession(cmd CmdType, status uint8) {
+	m.active.Add(-1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		m.sessions = make(map[sessionKey]uint64)
+	}
+	m.sessions[sessionKey{cmd, status}]++
+}
+
+func (m *Metrics) dialError(status uint8) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dialErrors == nil {
+		m.dialErrors = make(map[uint8]uint64)
+	}
+	m.dialErrors[status]++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	writeHeader(&b, "relay_sessions_active", "gauge", "Number of sessions in progress.")
+	fmt.Fprintf(&b, "relay_sessions_active %d\n", m.active.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(&b, "relay_sessions_total", "counter", "Number of finished sessions by command and response status.")
+	keys := make([]sessionKey, 0, len(m.sessions))
+	for k := range m.sessions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cmd != keys[j].cmd {
+			return keys[i].cmd < keys[j].cmd
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "relay_sessions_total{command=%s,status=%s} %d\n",
+			labelValue(commandName(k.cmd)), labelValue(statusName(k.status)), m.sessions[k])
+	}
+
+	writeHeader(&b, "relay_bytes_total", "counter", "Number of bytes relayed by user, from (in) and to (out) the clients.")
+	users := make([]string, 0, len(m.users))
+	for u := range m.users {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		ub := m.users[u]
+		fmt.Fprintf(&b, "relay_bytes_total{user=%s,direction=\"in\"} %d\n", labelValue(u), ub.in.Load())
+		fmt.Fprintf(&b, "relay_bytes_total{user=%s,direction=\"out\"} %d\n", labelValue(u), ub.out.Load())
+	}
+
+	writeHeader(&b, "relay_handshake_duration_seconds", "histogram", "Latency from the start of a session to its response.")
+	var cum uint64
+	for i, le := range handshakeBuckets {
+		if m.handshake != nil {
+			cum += m.handshake[i]
+		}
+		fmt.Fprintf(&b, "relay_handshake_duration_seconds_bucket{le=\"%g\"} %d\n", le, cum)
+	}
+	fmt.Fprintf(&b, "relay_handshake_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyN)
+	fmt.Fprintf(&b, "relay_handshake_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(&b, "relay_handshake_duration_seconds_count %d\n", m.latencyN)
+
+	writeHeader(&b, "relay_dial_errors_total", "counter", "Number of failed dials to the targets by response status.")
+	statuses := make([]int, 0, len(m.dialErrors))
+	for st := range m.dialErrors {
+		statuses = append(statuses, int(st))
+	}
+	sort.Ints(statuses)
+	for _, st := range statuses {
+		fmt.Fprintf(&b, "relay_dial_errors_total{status=%s} %d\n", labelValue(statusName(uint8(st))), m.dialErrors[uint8(st)])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func commandName(cmd CmdType) string {
+	switch cmd {
+	case CmdConnect:
+		return "connect"
+	case CmdBind:
+		return "bind"
+	case CmdAssociate:
+		return "associate"
+	default:
+		return fmt.Sprintf("%#x", uint8(cmd))
+	}
+}
+
+func statusName(status uint8) string {
+	if text := StatusText(status); text != "" {
+		return text
+	}
+	return fmt.Sprintf("%#x", status)
+}
+
+// session tracks a request for the metrics and the access log, it counts the bytes read from
+// and written to the client and records the status of the response.
+type session struct {
+	net.Conn
+
+	start     time.Time
+	user      string
+	cmd       CmdType
+	target    string
+	status    uint8
+	responded bool
+	in, out   atomic.Uint64
+	metrics   *Metrics
+	ub        *userBytes // nil without metrics
+}
+
+func (s *session) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	s.in.Add(uint64(n))
+	if s.ub != nil {
+		s.ub.in.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (s *session) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	s.out.Add(uint64(n))
+	if s.ub != nil {
+		s.ub.out.Add(uint64(n))
+	}
+	return n, err
+}
+
+// startSession starts tracking the request req of user on conn, which has been accepted at start.
+// The bytes of an unauthenticated user are counted as the bytes of the anonymous user.
+// It returns conn untouched if the server has neither metrics nor logger.
+func (s *Server) startSession(conn net.Conn, start time.Time, user string, authenticated bool, req *Request) net.Conn {
+	if s.Metrics == nil && s.Logger == nil {
+		return conn
+	}
+	_, target := targetOf(req)
+	sess := &session{Conn: conn, start: start, user: user, cmd: req.Cmd & CmdMask, target: target}
+	if s.Metrics != nil {
+		s.Metrics.active.Add(1)
+		sess.metrics = s.Metrics
+		if !authenticated {
+			user = ""
+		}
+		sess.ub = s.Metrics.userBytes(user)
+	}
+	return sess
+}
+
+// respond records the response status of conn if it is a session, possibly under quota.
+func respond(conn io.Writer, status uint8) {
+	if lc, ok := conn.(*limitedConn); ok {
+		conn = lc.Conn
+	}
+	if sess, ok := conn.(*session); ok && !sess.responded {
+		sess.responded = true
+		sess.status = status
+		if m := sess.metrics; m != nil {
+			m.observeHandshake(time.Since(sess.start))
+		}
+	}
+}
+
+// endSession updates the metrics and writes the access log of conn if it is a session.
+func (s *Server) endSession(conn net.Conn) {
+	sess, ok := conn.(*session)
+	if !ok {
+		return
+	}
+	if s.Metrics != nil {
+		s.Metrics.endSession(sess.cmd, sess.status)
+	}
+	if s.Logger != nil {
+		s.Logger.Info("session",
+			zap.String("remote", sess.RemoteAddr().String()),
+			zap.String("user", sess.user),
+			zap.String("command", commandName(sess.cmd)),
+			zap.String("target", sess.target),
+			zap.Duration("duration", time.Since(sess.start)),
+			zap.Uint64("bytes_in", sess.in.Load()),
+			zap.Uint64("bytes_out", sess.out.Load()),
+			zap.String("status", statusName(sess.status)),
+		)
+	}
+}
@@ -0,0 +1,89 @@
+package relay_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/w/net/http/httptest"
+)
+
+func TestServerMetrics(t *testing.T) {
+	echo := startEchoServer(t)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	metrics := &Metrics{}
+	ln := startRelayServer(t, &Server{
+		Authenticator: StaticAuthenticator{"alice": "secret"},
+		Metrics:       metrics,
+		Logger:        zap.New(core),
+	})
+
+	c := &Client{Addr: ln.Addr().String(), Username: "alice", Password: "secret"}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+	conn.Close()
+	if _, err := c.Dial("tcp", closed); err == nil {
+		t.Fatal("Dial to a closed port succeeded")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.Len() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("got %d access log entries, want 2", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if entries[1].ContextMap()["target"] == echo.Addr().String() {
+		fields = entries[1].ContextMap()
+	}
+	for k, want := range map[string]interface{}{
+		"user":      "alice",
+		"command":   "connect",
+		"target":    echo.Addr().String(),
+		"status":    "OK",
+		"bytes_out": uint64(4 + 4), // the response and the echo
+	} {
+		if fields[k] != want {
+			t.Errorf("access log %s = %v, want %v", k, fields[k], want)
+		}
+	}
+
+	ts := httptest.NewServer(metrics)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	for _, line := range []string{
+		"relay_sessions_active 0",
+		`relay_sessions_total{command="connect",status="OK"} 1`,
+		`relay_sessions_total{command="connect",status="host unreachable"} 1`,
+		`relay_dial_errors_total{status="host unreachable"} 1`,
+		`relay_handshake_duration_seconds_count 2`,
+		`relay_bytes_total{user="alice",direction="out"} 12`,
+		"# TYPE relay_handshake_duration_seconds histogram",
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, b)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+
+	"github.com/gptlocal/netool/p/net/mux"
+)
+
+// handleMux runs a mux session on conn, every stream opened by the client is served
+// as a connection of its own, with the TLS state cs of conn.
+func (s *Server) handleMux(conn net.Conn, req *Request, cs *tls.ConnectionState) {
+	if err := writeResponse(conn, req.Version, StatusOK); err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	sess := mux.Server(conn, nil)
+	defer sess.Close()
+	s.setConnState(conn, sess)
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			if err != mux.ErrSessionClosed {
+				log.Printf("relay: %s: mux session: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		go func() {
+			defer st.Close()
+			s.serveConn(st, cs)
+		}()
+	}
+}
+
+// openStream opens a stream of the mux session with the server, the session is
+// established on first use.
+func (c *Client) openStream(ctx context.Context) (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sess == nil || c.sess.IsClosed() {
+		conn, _, err := c.roundTrip(ctx, c.newRequest(CmdMux))
+		if err != nil {
+			return nil, err
+		}
+		c.sess = mux.Client(conn, nil)
+	}
+	return c.sess.OpenStream()
+}
+
+// Close closes the mux session with the server, the connections dialed over it are closed too.
+// The idle HTTP/2 connections of the relay+h2 carrier are closed as well.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.h2mu.Lock()
+	if c.h2 != nil {
+		c.h2.CloseIdleConnections()
+	}
+	c.h2mu.Unlock()
+
+	if c.sess == nil {
+		return nil
+	}
+	err := c.sess.Close()
+	c.sess = nil
+	if err == mux.ErrSessionClosed {
+		err = nil
+	}
+	return err
+}
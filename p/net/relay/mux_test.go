@@ -0,0 +1,123 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return conn, err
+}
+
+func TestClientMux(t *testing.T) {
+	echo := startEchoServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cln := &countingListener{Listener: ln}
+	go (&Server{ACL: loopbackACL}).Serve(cln)
+	defer ln.Close()
+
+	c := &Client{Addr: ln.Addr().String(), Mux: true}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := c.Dial("tcp", echo.Addr().String())
+			if err != nil {
+				t.Errorf("Dial: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			msg := []byte(fmt.Sprintf("hello stream %d", i))
+			conn.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Errorf("read: %v", err)
+				return
+			}
+			if string(got) != string(msg) {
+				t.Errorf("got %q, want %q", got, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := cln.n.Load(); n != 1 {
+		t.Errorf("server accepted %d connections, want 1", n)
+	}
+}
+
+func TestClientMuxBind(t *testing.T) {
+	ln := startRelayServer(t, &Server{ACL: loopbackACL})
+	c := &Client{Addr: ln.Addr().String(), Mux: true}
+	defer c.Close()
+
+	bln, err := c.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	defer bln.Close()
+	go func() {
+		conn, err := bln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := c.Dial("tcp", bln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("bind and connect over one connection")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+}
+
+func TestClientMuxReconnect(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{ACL: loopbackACL})
+	c := &Client{Addr: ln.Addr().String(), Mux: true}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := c.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial #%d: %v", i, err)
+		}
+		conn.Close()
+		c.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+)
+
+// Quota limits the resources used by a user, a zero field means no limit.
+type Quota struct {
+	// UserBandwidth is the rate in bytes per second shared by all the streams of the user,
+	// counting both directions.
+	UserBandwidth int64
+
+	// StreamBandwidth is the rate in bytes per second of each stream, counting both directions.
+	StreamBandwidth int64
+
+	// MaxStreams is the maximum number of concurrent streams of the user. A stream is a
+	// CONNECT, BIND or ASSOCIATE request, whether on a connection of its own or on a mux session.
+	MaxStreams int
+}
+
+func (s *Server) quotaOf(user string) Quota {
+	if q, ok := s.UserQuotas[user]; ok {
+		return q
+	}
+	return s.Quota
+}
+
+type userUsage struct {
+	streams int
+	limiter *rate.Limiter // nil if the bandwidth is not limited
+}
+
+// quotaRegistry tracks the streams and the bandwidth of the users.
+type quotaRegistry struct {
+	mu    sync.Mutex
+	users map[string]*userUsage
+}
+
+// acquire accounts a new stream of user, it reports false if the user has reached q.MaxStreams.
+// The returned func releases the stream.
+func (r *quotaRegistry) acquire(user string, q Quota) (*userUsage, func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.users == nil {
+		r.users = make(map[string]*userUsage)
+	}
+	u := r.users[user]
+	if u == nil {
+		u = &userUsage{}
+		if q.UserBandwidth > 0 {
+			u.limiter = newLimiter(q.UserBandwidth)
+		}
+		r.users[user] = u
+	}
+	if q.MaxStreams > 0 && u.streams >= q.MaxStreams {
+		return nil, nil, false
+	}
+	u.streams++
+
+	release := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if u.streams--; u.streams == 0 {
+			delete(r.users, user)
+		}
+	}
+	return u, release, true
+}
+
+// newLimiter returns a limiter of bytesPerSec. The burst is one second of the rate,
+// and at least a copy buffer so a full buffer fits in a single wait.
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	burst := bytesPerSec
+	if burst < netutil.BufferSize {
+		burst = netutil.BufferSize
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// limitConn throttles the reads and writes on conn with the limiters of u and q.StreamBandwidth.
+// It returns conn if the bandwidth is not limited.
+func limitConn(conn net.Conn, u *userUsage, q Quota) net.Conn {
+	var limiters []*rate.Limiter
+	if u.limiter != nil {
+		limiters = append(limiters, u.limiter)
+	}
+	if q.StreamBandwidth > 0 {
+		limiters = append(limiters, newLimiter(q.StreamBandwidth))
+	}
+	if len(limiters) == 0 {
+		return conn
+	}
+
+	c := &limitedConn{Conn: conn, limiters: limiters}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for _, l := range limiters {
+		if b := l.Burst(); c.chunk == 0 || b < c.chunk {
+			c.chunk = b
+		}
+	}
+	return c
+}
+
+// limitedConn waits for the tokens of every byte read or written.
+type limitedConn struct {
+	net.Conn
+	limiters []*rate.Limiter
+	chunk    int // maximum bytes per wait, the smallest burst of the limiters
+
+	ctx    context.Context // canceled on Close
+	cancel context.CancelFunc
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		sz := len(b)
+		if sz > c.chunk {
+			sz = c.chunk
+		}
+		if err = c.wait(sz); err != nil {
+			return
+		}
+		var nn int
+		nn, err = c.Conn.Write(b[:sz])
+		n += nn
+		if err != nil {
+			return
+		}
+		b = b[sz:]
+	}
+	return
+}
+
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) wait(n int) error {
+	for _, l := range c.limiters {
+		if err := l.WaitN(c.ctx, n); err != nil {
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package relay_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestServerMaxStreams(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{
+		Authenticator: StaticAuthenticator{"alice": "a", "bob": "b"},
+		Quota:         Quota{MaxStreams: 1},
+		UserQuotas:    map[string]Quota{"bob": {}},
+	})
+
+	alice := &Client{Addr: ln.Addr().String(), Username: "alice", Password: "a"}
+	conn, err := alice.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	_, err = alice.Dial("tcp", echo.Addr().String())
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != StatusQuotaExceeded {
+		t.Fatalf("second Dial error = %v, want status %#x", err, StatusQuotaExceeded)
+	}
+
+	bob := &Client{Addr: ln.Addr().String(), Username: "bob", Password: "b"}
+	for i := 0; i < 2; i++ {
+		c, err := bob.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial as bob: %v", err)
+		}
+		defer c.Close()
+	}
+
+	// The stream is released once the server sees the connection closed.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := alice.Dial("tcp", echo.Addr().String())
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial after close: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerBandwidth(t *testing.T) {
+	const rate = 256 << 10
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{Quota: Quota{StreamBandwidth: rate}})
+
+	c := &Client{Addr: ln.Addr().String()}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The echoed bytes count twice: read from and written to the client.
+	// The first second of the rate is the burst of the limiter.
+	msg := make([]byte, rate)
+	start := time.Now()
+	go conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if elapsed, min := time.Since(start), 750*time.Millisecond; elapsed < min {
+		t.Errorf("echoed %d bytes in %v at %d bytes/s, want at least %v", len(msg), elapsed, rate, min)
+	}
+}
+
+func TestServerBandwidthThroughput(t *testing.T) {
+	const rate = 1 << 20
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{Quota: Quota{StreamBandwidth: rate}})
+
+	c := &Client{Addr: ln.Addr().String()}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// 2MB are counted, the burst aside it takes a second at the rate.
+	msg := make([]byte, rate)
+	start := time.Now()
+	go conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if elapsed, max := time.Since(start), 3*time.Second; elapsed > max {
+		t.Errorf("echoed %d bytes in %v at %d bytes/s, want at most %v", len(msg), elapsed, rate, max)
+	}
+}
@@ -10,20 +10,34 @@ import (
 
 const (
 	Version1 = 0x01
+	Version2 = 0x02
 
-	featureHeaderLen = 3
+	featureHeaderLen   = 3
+	featureHeaderLenV2 = 4
+
+	// maxFeaturesLenV2 bounds the features length accepted in the Version2 wire format,
+	// the message is read before the peer is authenticated.
+	maxFeaturesLenV2 = 4096
+
+	// maxFeatures bounds the number of features accepted in a single message.
+	maxFeatures = 64
 )
 
 var (
-	ErrBadVersion = errors.New("bad version")
+	ErrBadVersion      = errors.New("bad version")
+	ErrTooManyFeatures = errors.New("too many features")
 )
 
+// supportedVersions are the protocol versions implemented by this package, in order of preference.
+var supportedVersions = []uint8{Version2, Version1}
+
 type CmdType uint8
 
 const (
 	CmdConnect   CmdType = 0x01
 	CmdBind      CmdType = 0x02
 	CmdAssociate CmdType = 0x03
+	CmdMux       CmdType = 0x04 // runs a mux session, each stream carries a request of its own
 	CmdMask      CmdType = 0x0F
 
 	// FUDP is a command flag indicating that the request is UDP-oriented.
@@ -44,6 +58,8 @@ const (
 //	CMD/FLAGS - command (low 4-bit) and flags (high 4-bit), 1 byte.
 //	FEALEN - length of features, 2 bytes.
 //	FEATURES - feature list.
+//
+// In Version2, FEALEN is 4 bytes and each feature carries a flags byte, see features.ReadFeatureV2.
 type Request struct {
 	Version  uint8
 	Cmd      CmdType
@@ -51,21 +67,55 @@ type Request struct {
 }
 
 func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
-	var header [4]byte
-	nn, err := io.ReadFull(r, header[:])
+	req.Version, req.Cmd = 0, 0
+	var header [2]byte
+	n, err = readMessage(r, header[:], &req.Features)
+	req.Version = header[0]
+	req.Cmd = CmdType(header[1])
+	return
+}
+
+func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+	return writeMessage(w, req.Version, byte(req.Cmd), req.Features)
+}
+
+// readMessage reads a request or response, the first two bytes are stored in header
+// and the features in fs.
+func readMessage(r io.Reader, header []byte, fs *[]features.Feature) (n int64, err error) {
+	*fs = nil
+	nn, err := io.ReadFull(r, header[:2])
 	n += int64(nn)
 	if err != nil {
 		return
 	}
 
-	if header[0] != Version1 {
+	var flen int
+	switch header[0] {
+	case Version1:
+		var b [2]byte
+		nn, err = io.ReadFull(r, b[:])
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+		flen = int(binary.BigEndian.Uint16(b[:]))
+	case Version2:
+		var b [4]byte
+		nn, err = io.ReadFull(r, b[:])
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+		v := binary.BigEndian.Uint32(b[:])
+		if v > maxFeaturesLenV2 {
+			err = errors.New("features maximum length exceeded")
+			return
+		}
+		flen = int(v)
+	default:
 		err = ErrBadVersion
 		return
 	}
-	req.Version = header[0]
-	req.Cmd = CmdType(header[1])
-
-	flen := int(binary.BigEndian.Uint16(header[2:]))
 
 	if flen == 0 {
 		return
@@ -76,53 +126,85 @@ func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
 	if err != nil {
 		return
 	}
-	req.Features, err = readFeatures(bf)
+	*fs, err = readFeatures(header[0], bf)
 	return
 }
 
-func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+func writeMessage(w io.Writer, version uint8, code byte, fs []features.Feature) (n int64, err error) {
+	if len(fs) > maxFeatures {
+		return 0, ErrTooManyFeatures
+	}
+
 	var buf bytes.Buffer
 
-	buf.WriteByte(req.Version)
-	buf.WriteByte(byte(req.Cmd))
-	buf.Write([]byte{0, 0}) // placeholder for features length
-	n += 4
+	buf.WriteByte(version)
+	buf.WriteByte(code)
+	hlen := 4
+	if version == Version2 {
+		hlen = 6
+	}
+	buf.Write(make([]byte, hlen-2)) // placeholder for features length
 
 	flen := 0
-	for _, f := range req.Features {
+	for _, f := range fs {
 		var b []byte
 		b, err = f.Encode()
 		if err != nil {
 			return
 		}
-		binary.Write(&buf, binary.BigEndian, f.Type())
+		if len(b) > 0xFFFF {
+			err = errors.New("feature maximum length exceeded")
+			return
+		}
+		buf.WriteByte(byte(f.Type()))
+		if version == Version2 {
+			buf.WriteByte(byte(features.FlagsOf(f)))
+			flen++
+		}
 		binary.Write(&buf, binary.BigEndian, uint16(len(b)))
 		flen += featureHeaderLen
 		nn, _ := buf.Write(b)
 		flen += nn
 	}
-	n += int64(flen)
-	if flen > 0xFFFF {
-		err = errors.New("features maximum length exceeded")
-		return
-	}
 
 	b := buf.Bytes()
-	binary.BigEndian.PutUint16(b[2:4], uint16(flen))
+	if version == Version2 {
+		if flen > maxFeaturesLenV2 {
+			err = errors.New("features maximum length exceeded")
+			return
+		}
+		binary.BigEndian.PutUint32(b[2:6], uint32(flen))
+	} else {
+		if flen > 0xFFFF {
+			err = errors.New("features maximum length exceeded")
+			return
+		}
+		binary.BigEndian.PutUint16(b[2:4], uint16(flen))
+	}
 
 	return buf.WriteTo(w)
 }
 
-func readFeatures(b []byte) (fs []features.Feature, err error) {
+func readFeatures(version uint8, b []byte) (fs []features.Feature, err error) {
 	if len(b) == 0 {
 		return
 	}
 	br := bytes.NewReader(b)
 	for br.Len() > 0 {
+		if len(fs) == maxFeatures {
+			return nil, ErrTooManyFeatures
+		}
 		var f features.Feature
-		f, err = features.ReadFeature(br)
+		if version == Version2 {
+			f, err = features.ReadFeatureV2(br)
+		} else {
+			f, err = features.ReadFeature(br)
+		}
 		if err != nil {
-			return
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
 		fs = append(fs, f)
 	}
@@ -143,6 +225,8 @@ func readFeatures(b []byte) (fs []features.Feature, err error) {
 //	STATUS - server status, 1 byte.
 //	FEALEN - length of features, 2 bytes.
 //	FEATURES - feature list.
+//
+// In Version2, FEALEN is 4 bytes and each feature carries a flags byte, see features.ReadFeatureV2.
 type Response struct {
 	Version  uint8
 	Status   uint8
@@ -150,65 +234,14 @@ type Response struct {
 }
 
 func (resp *Response) ReadFrom(r io.Reader) (n int64, err error) {
-	var header [4]byte
-	nn, err := io.ReadFull(r, header[:])
-	n += int64(nn)
-	if err != nil {
-		return
-	}
-
-	if header[0] != Version1 {
-		err = ErrBadVersion
-		return
-	}
+	resp.Version, resp.Status = 0, 0
+	var header [2]byte
+	n, err = readMessage(r, header[:], &resp.Features)
 	resp.Version = header[0]
 	resp.Status = header[1]
-
-	flen := int(binary.BigEndian.Uint16(header[2:]))
-
-	if flen == 0 {
-		return
-	}
-	bf := make([]byte, flen)
-	nn, err = io.ReadFull(r, bf)
-	n += int64(nn)
-	if err != nil {
-		return
-	}
-
-	resp.Features, err = readFeatures(bf)
 	return
 }
 
 func (resp *Response) WriteTo(w io.Writer) (n int64, err error) {
-	var buf bytes.Buffer
-
-	buf.WriteByte(resp.Version)
-	buf.WriteByte(resp.Status)
-	buf.Write([]byte{0, 0}) // placeholder for features length
-	n += 4
-
-	flen := 0
-	for _, f := range resp.Features {
-		var b []byte
-		b, err = f.Encode()
-		if err != nil {
-			return
-		}
-		binary.Write(&buf, binary.BigEndian, f.Type())
-		binary.Write(&buf, binary.BigEndian, uint16(len(b)))
-		flen += featureHeaderLen
-		nn, _ := buf.Write(b)
-		flen += nn
-	}
-	n += int64(flen)
-	if flen > 0xFFFF {
-		err = errors.New("features maximum length exceeded")
-		return
-	}
-
-	b := buf.Bytes()
-	binary.BigEndian.PutUint16(b[2:4], uint16(flen))
-
-	return buf.WriteTo(w)
+	return writeMessage(w, resp.Version, resp.Status, resp.Features)
 }
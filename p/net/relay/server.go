@@ -0,0 +1,338 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+var (
+	ErrServerClosed = errors.New("relay: server closed")
+)
+
+// Dialer connects to the targets requested by relay clients.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Server serves relay requests accepted from a net.Listener.
+type Server struct {
+	// Addr is the TCP address to listen on, used by ListenAndServe.
+	Addr string
+
+	// Dialer dials the target of a CONNECT request. If nil, a zero net.Dialer is used.
+	Dialer Dialer
+
+	// Listener listens on the address of a BIND request. If nil, a zero net.ListenConfig is used.
+	Listener Listener
+
+	// PacketListener creates the UDP socket of an ASSOCIATE request. If nil, a zero net.ListenConfig is used.
+	PacketListener PacketListener
+
+	// Versions are the protocol versions accepted by the server. If empty, Version1 and Version2 are accepted.
+	Versions []uint8
+
+	// Authenticator verifies the UserAuthFeature of every request. If nil, no authentication is required.
+	Authenticator Authenticator
+
+	// TLSConfig, if not nil, makes Serve accept TLS connections only. Set ClientAuth and ClientCAs
+	// for mutual TLS, a request over a connection with a verified client certificate is
+	// authenticated as the user of the certificate.
+	TLSConfig *tls.Config
+
+	// ClientCertUser maps a verified client certificate to a username.
+	// If nil, the subject common name is used.
+	ClientCertUser func(cert *x509.Certificate) string
+
+	// ACL controls the destinations of CONNECT and ASSOCIATE requests and the addresses of BIND
+	// requests. If nil, every address is allowed except the loopback, link-local, private and
+	// unspecified addresses.
+	ACL *ACL
+
+	// BindPorts are the ports ("8000") and port ranges ("8000-8999") a BIND request may listen on,
+	// besides 0 which lets the system pick a port. If empty, only 0 is allowed.
+	BindPorts []string
+
+	// HandshakeTimeout is the maximum duration for reading the request. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// DialTimeout is the maximum duration for connecting to the target. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// Quota limits the streams and the bandwidth of every user, UserQuotas overrides it for
+	// the listed users. The anonymous clients share the quota of the user "".
+	Quota      Quota
+	UserQuotas map[string]Quota
+
+	// Metrics, if not nil, collects the metrics of the sessions, serve it over HTTP to expose them.
+	Metrics *Metrics
+
+	// Logger, if not nil, writes an access log entry for every finished session.
+	Logger *zap.Logger
+
+	tunnels tunnelRegistry
+	quotas  quotaRegistry
+
+	mu         sync.Mutex // protects the fields below
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]*connState
+}
+
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener and serves each of them in a new goroutine.
+// It always returns a non-nil error, ln is closed on return.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	defer ln.Close()
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("relay: accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) || s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn reads a single request from conn and handles it. conn is closed on return.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	var cs *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		if s.HandshakeTimeout > 0 {
+			tc.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			log.Printf("relay: tls handshake with %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		state := tc.ConnectionState()
+		cs = &state
+	}
+	s.serveConn(conn, cs)
+}
+
+// serveConn serves a request from conn, cs is the state of the TLS connection carrying conn, if any.
+func (s *Server) serveConn(conn net.Conn, cs *tls.ConnectionState) {
+	start := time.Now()
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	if s.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	req := &Request{}
+	if _, err := req.ReadFrom(conn); err != nil {
+		log.Printf("relay: read request from %s: %v", conn.RemoteAddr(), err)
+		switch {
+		case errors.Is(err, ErrBadVersion):
+			s.rejectVersion(conn)
+		case errors.Is(err, features.ErrUnsupportedCritical):
+			writeResponse(conn, req.Version, StatusBadRequest)
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	// The authentication may take a while, Shutdown must not close the conn as idle meanwhile.
+	s.setConnState(conn, nil)
+
+	if !s.supportsVersion(req.Version) {
+		log.Printf("relay: %s: unsupported version %#x", conn.RemoteAddr(), req.Version)
+		s.rejectVersion(conn)
+		return
+	}
+
+	user, ok := s.authenticate(context.Background(), req, cs)
+	if req.Cmd&CmdMask != CmdMux {
+		conn = s.startSession(conn, start, user, ok, req)
+		defer s.endSession(conn)
+	}
+	if !ok {
+		log.Printf("relay: %s: authentication failed for user %q", conn.RemoteAddr(), user)
+		writeResponse(conn, req.Version, StatusUnauthorized)
+		return
+	}
+	ctx := contextWithUser(context.Background(), user)
+
+	if req.Cmd&CmdMask != CmdMux {
+		q := s.quotaOf(user)
+		u, release, ok := s.quotas.acquire(user, q)
+		if !ok {
+			log.Printf("relay: %s: user %q exceeds %d streams", conn.RemoteAddr(), user, q.MaxStreams)
+			writeResponse(conn, req.Version, StatusQuotaExceeded)
+			return
+		}
+		defer release()
+		conn = limitConn(conn, u, q)
+		// Closing the limited conn cancels its pending waits for tokens.
+		defer conn.Close()
+	}
+
+	switch req.Cmd & CmdMask {
+	case CmdConnect:
+		s.handleConnect(ctx, conn, req)
+	case CmdBind:
+		s.handleBind(ctx, conn, req)
+	case CmdAssociate:
+		s.handleAssociate(ctx, conn, req)
+	case CmdMux:
+		s.handleMux(conn, req, cs)
+	default:
+		log.Printf("relay: %s: unsupported command %#x", conn.RemoteAddr(), req.Cmd&CmdMask)
+		writeResponse(conn, req.Version, StatusBadRequest)
+	}
+}
+
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *Request) {
+	if tf := tunnelOf(req); tf != nil {
+		s.handleTunnelConnect(conn, req, tf)
+		return
+	}
+
+	network, address := targetOf(req)
+	if address == "" {
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+	if network != "tcp" && network != "udp" {
+		log.Printf("relay: %s: unsupported network %s", conn.RemoteAddr(), network)
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	cc, err := s.dial(ctx, network, address)
+	if err != nil {
+		log.Printf("relay: %s: dial %s/%s: %v", conn.RemoteAddr(), address, network, err)
+		status := StatusFromError(err)
+		s.Metrics.dialError(status)
+		writeResponse(conn, req.Version, status)
+		return
+	}
+	defer cc.Close()
+
+	if err := writeResponse(conn, req.Version, StatusOK); err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if network == "udp" {
+		target := &features.AddrFeature{}
+		target.ParseFrom(address)
+		s.handleConnectUDP(conn, cc, target)
+		return
+	}
+
+	if err := netutil.Transport(conn, cc); err != nil {
+		log.Printf("relay: %s <-> %s: %v", conn.RemoteAddr(), address, err)
+	}
+}
+
+func (s *Server) versions() []uint8 {
+	if len(s.Versions) > 0 {
+		return s.Versions
+	}
+	return supportedVersions
+}
+
+func (s *Server) supportsVersion(v uint8) bool {
+	for _, sv := range s.versions() {
+		if sv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectVersion advertises the versions supported by the server in a Version1 response,
+// every version of the protocol is able to read it.
+func (s *Server) rejectVersion(conn net.Conn) {
+	writeResponse(conn, Version1, StatusUnsupportedVersion, &features.VersionFeature{Versions: s.versions()})
+}
+
+func (s *Server) acl() *ACL {
+	if s.ACL != nil {
+		return s.ACL
+	}
+	return &ACL{}
+}
+
+// targetOf returns the network and address carried by the request features.
+func targetOf(req *Request) (network, address string) {
+	network = "tcp"
+	for _, f := range req.Features {
+		switch f := f.(type) {
+		case *features.AddrFeature:
+			address = f.String()
+		case *features.NetworkFeature:
+			network = f.Network.String()
+		}
+	}
+	if req.Cmd&FUDP != 0 {
+		network = "udp"
+	}
+	return
+}
+
+func writeResponse(w io.Writer, version uint8, status uint8, fs ...features.Feature) error {
+	respond(w, status)
+	resp := Response{
+		Version:  version,
+		Status:   status,
+		Features: fs,
+	}
+	_, err := resp.WriteTo(w)
+	return err
+}
@@ -0,0 +1,172 @@
+package relay_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// loopbackACL lets the tests relay to their local servers.
+var loopbackACL = &ACL{AllowPrivate: true}
+
+// startRelayServer serves srv on a local listener, with loopbackACL if srv.ACL is nil.
+func startRelayServer(t *testing.T, srv *Server) net.Listener {
+	t.Helper()
+	if srv.ACL == nil {
+		srv.ACL = loopbackACL
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func connectRequest(address string) *Request {
+	af := &features.AddrFeature{}
+	af.ParseFrom(address)
+	return &Request{
+		Version:  Version1,
+		Cmd:      CmdConnect,
+		Features: []features.Feature{af},
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := connectRequest(echo.Addr().String()).WriteTo(conn); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Status != StatusOK {
+		t.Fatalf("resp.Status = %#x, want %#x", resp.Status, StatusOK)
+	}
+
+	msg := []byte("hello relay")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+}
+
+func TestServerConnectUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	ln := startRelayServer(t, &Server{})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	connectRequest(addr).WriteTo(conn)
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Status != StatusHostUnreachable {
+		t.Errorf("resp.Status = %#x, want %#x", resp.Status, StatusHostUnreachable)
+	}
+}
+
+func TestServerBadRequest(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	req := &Request{Version: Version1, Cmd: CmdConnect}
+	req.WriteTo(conn)
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Status != StatusBadRequest {
+		t.Errorf("resp.Status = %#x, want %#x", resp.Status, StatusBadRequest)
+	}
+}
+
+func TestServerIgnoresUnknownFeature(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+
+	req := connectRequest(echo.Addr().String())
+	req.Features = append(req.Features, &features.UnknownFeature{FeatureType: 0x7f, Data: []byte("from the future")})
+
+	var buf bytes.Buffer
+	req.WriteTo(&buf)
+	encoded := buf.Bytes()
+
+	decoded := &Request{}
+	if _, err := decoded.ReadFrom(bytes.NewReader(encoded)); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	var reencoded bytes.Buffer
+	decoded.WriteTo(&reencoded)
+	if !bytes.Equal(reencoded.Bytes(), encoded) {
+		t.Errorf("re-encoded request = %x, want %x", reencoded.Bytes(), encoded)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(encoded)
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Status != StatusOK {
+		t.Errorf("resp.Status = %#x, want %#x", resp.Status, StatusOK)
+	}
+}
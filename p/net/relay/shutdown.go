@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/mux"
+)
+
+// shutdownPollIntervalMax is the maximum interval between two checks of the connections
+// during Shutdown.
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// connState is the state of a connection or a stream being served.
+type connState struct {
+	active bool         // a request has been read
+	sess   *mux.Session // the mux session carried by the connection, if any
+}
+
+// idle reports whether the connection can be closed without cutting a session.
+func (cs *connState) idle() bool {
+	if cs.sess != nil {
+		return cs.sess.NumStreams() == 0
+	}
+	return !cs.active
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown,
+// it reports false if the server is shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes conn from the connections drained by Shutdown,
+// it reports false if the server is shutting down.
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*connState)
+	}
+	s.conns[conn] = &connState{}
+	return true
+}
+
+// setConnState marks conn as serving a session, or as carrying sess if not nil.
+func (s *Server) setConnState(conn net.Conn, sess *mux.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cs, ok := s.conns[conn]; ok {
+		cs.active = sess == nil
+		cs.sess = sess
+	}
+}
+
+// Shutdown gracefully shuts down the server: it closes the listeners and the idle connections,
+// then waits for the sessions in progress to finish. A connection is idle while it has not sent
+// its request, or if it carries a mux session without streams.
+//
+// If ctx expires first, the remaining connections are closed and Shutdown returns the number
+// of sessions cut with the context's error. Serve and ListenAndServe return ErrServerClosed
+// once Shutdown is called, as do the connections passed to ServeConn and ServeHTTP afterwards.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.inShutdown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if s.closeIdleConns() {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return s.closeConns(), ctx.Err()
+		case <-timer.C:
+			if interval *= 2; interval > shutdownPollIntervalMax {
+				interval = shutdownPollIntervalMax
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// closeIdleConns closes the idle connections, it reports whether there was no other one.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for conn, cs := range s.conns {
+		if cs.idle() {
+			conn.Close()
+			delete(s.conns, conn)
+		} else {
+			quiescent = false
+		}
+	}
+	return quiescent
+}
+
+// closeConns closes all the connections, it returns the number of sessions in progress.
+func (s *Server) closeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for conn, cs := range s.conns {
+		if cs.active {
+			n++
+		}
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return n
+}
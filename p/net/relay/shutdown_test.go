@@ -0,0 +1,162 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestServerShutdown(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := &Server{ACL: loopbackACL}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	c := &Client{Addr: ln.Addr().String()}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	// An idle connection, which has not sent its request.
+	idle, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer idle.Close()
+	// An idle mux session.
+	mc := &Client{Addr: ln.Addr().String(), Mux: true}
+	defer mc.Close()
+	mconn, err := mc.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial over mux: %v", err)
+	}
+	mconn.Close()
+
+	done := make(chan struct{})
+	var cut int
+	go func() {
+		defer close(done)
+		cut, err = srv.Shutdown(context.Background())
+	}()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve = %v, want %v", err, ErrServerClosed)
+	}
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the idle connection = %v, want EOF", err)
+	}
+
+	// The session in progress still works.
+	msg := []byte("draining")
+	conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("read while draining: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before the session finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the session finished")
+	}
+	if cut != 0 || err != nil {
+		t.Errorf("Shutdown = %d, %v, want 0, nil", cut, err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := &Server{}
+	ln := startRelayServer(t, srv)
+
+	c := &Client{Addr: ln.Addr().String()}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := c.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cut, err := srv.Shutdown(ctx)
+	if cut != 2 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %d, %v, want 2, %v", cut, err, context.DeadlineExceeded)
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read from a cut session = %v, want EOF", err)
+		}
+	}
+}
+
+func TestServerShutdownDuringAuthentication(t *testing.T) {
+	echo := startEchoServer(t)
+	authenticating := make(chan struct{})
+	proceed := make(chan struct{})
+	srv := &Server{
+		ACL: loopbackACL,
+		Authenticator: AuthenticatorFunc(func(ctx context.Context, username, password string) bool {
+			close(authenticating)
+			<-proceed
+			return password == "p"
+		}),
+	}
+	ln := startRelayServer(t, srv)
+
+	dialed := make(chan error, 1)
+	go func() {
+		c := &Client{Addr: ln.Addr().String(), Username: "u", Password: "p"}
+		conn, err := c.Dial("tcp", echo.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	<-authenticating
+
+	done := make(chan struct{})
+	var cut int
+	var err error
+	go func() {
+		defer close(done)
+		cut, err = srv.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a request was being authenticated")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(proceed)
+	if err := <-dialed; err != nil {
+		t.Errorf("Dial: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the session finished")
+	}
+	if cut != 0 || err != nil {
+		t.Errorf("Shutdown = %d, %v, want 0, nil", cut, err)
+	}
+}
@@ -0,0 +1,217 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/relay"
+)
+
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// Upstream carries the SOCKS requests, *relay.Client satisfies this interface.
+type Upstream interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	ListenPacket(ctx context.Context, network string) (net.PacketConn, error)
+}
+
+// Server serves SOCKS5 clients, CONNECT requests are sent to Upstream as relay CONNECT requests
+// and UDP ASSOCIATE requests as relay ASSOCIATE requests. BIND is not supported.
+type Server struct {
+	// Addr is the TCP address to listen on, used by ListenAndServe.
+	Addr string
+
+	// Upstream carries the requests, usually a *relay.Client.
+	Upstream Upstream
+
+	// Authenticator, if not nil, requires the username/password authentication of RFC 1929.
+	Authenticator relay.Authenticator
+
+	// HandshakeTimeout is the maximum duration for the authentication and the request.
+	// Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// DialTimeout is the maximum duration for the upstream to connect to the target or to
+	// set up a UDP association, 30 seconds if zero.
+	DialTimeout time.Duration
+}
+
+const defaultDialTimeout = 30 * time.Second
+
+// dialContext returns the context bounding a request to the upstream.
+func (s *Server) dialContext() (context.Context, context.CancelFunc) {
+	timeout := s.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener and serves each of them in a new goroutine.
+// It always returns a non-nil error, ln is closed on return.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("socks5: accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return ErrServerClosed
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn negotiates the authentication, reads a single request from conn and handles it.
+// conn is closed on return.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	if s.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	if err := s.authenticate(conn); err != nil {
+		log.Printf("socks5: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	req := &Request{}
+	if _, err := req.ReadFrom(conn); err != nil {
+		log.Printf("socks5: %s: read request: %v", conn.RemoteAddr(), err)
+		if errors.Is(err, ErrBadVersion) {
+			return
+		}
+		(&Reply{Rep: AddressTypeNotSupported}).WriteTo(conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch req.Cmd {
+	case CmdConnect:
+		s.handleConnect(conn, req)
+	case CmdUDPAssociate:
+		s.handleUDPAssociate(conn, req)
+	default:
+		log.Printf("socks5: %s: unsupported command %#x", conn.RemoteAddr(), req.Cmd)
+		(&Reply{Rep: CommandNotSupported}).WriteTo(conn)
+	}
+}
+
+// authenticate selects the authentication method and runs it.
+func (s *Server) authenticate(conn net.Conn) error {
+	methods, err := readMethods(conn)
+	if err != nil {
+		return err
+	}
+	want := MethodNoAuth
+	if s.Authenticator != nil {
+		want = MethodUserPass
+	}
+	method := MethodNoAcceptable
+	for _, m := range methods {
+		if m == want {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{Version5, method}); err != nil {
+		return err
+	}
+	switch method {
+	case MethodNoAcceptable:
+		return errors.New("socks5: no acceptable authentication method")
+	case MethodNoAuth:
+		return nil
+	}
+
+	username, password, err := readUserPass(conn)
+	if err != nil {
+		return err
+	}
+	ok := s.Authenticator.Authenticate(context.Background(), username, password)
+	status := byte(0)
+	if !ok {
+		status = 1
+	}
+	if _, err := conn.Write([]byte{userAuthVersion, status}); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func (s *Server) handleConnect(conn net.Conn, req *Request) {
+	ctx, cancel := s.dialContext()
+	cc, err := s.Upstream.DialContext(ctx, "tcp", req.Addr.String())
+	cancel()
+	if err != nil {
+		log.Printf("socks5: %s: connect %s: %v", conn.RemoteAddr(), req.Addr.String(), err)
+		(&Reply{Rep: replyFromError(err)}).WriteTo(conn)
+		return
+	}
+	defer cc.Close()
+
+	rep := &Reply{Rep: Succeeded}
+	rep.Addr.ParseFrom(cc.LocalAddr().String())
+	if _, err := rep.WriteTo(conn); err != nil {
+		log.Printf("socks5: %s: write reply: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := netutil.Transport(conn, cc); err != nil {
+		log.Printf("socks5: %s <-> %s: %v", conn.RemoteAddr(), req.Addr.String(), err)
+	}
+}
+
+// replyFromError maps an error of the upstream to a reply code.
+func replyFromError(err error) uint8 {
+	var se *relay.StatusError
+	if !errors.As(err, &se) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return TTLExpired
+		}
+		return GeneralFailure
+	}
+	switch se.Status {
+	case relay.StatusForbidden, relay.StatusUnauthorized, relay.StatusQuotaExceeded:
+		return NotAllowed
+	case relay.StatusNetworkUnreachable:
+		return NetworkUnreachable
+	case relay.StatusHostUnreachable:
+		return HostUnreachable
+	case relay.StatusTimeout:
+		return TTLExpired
+	default:
+		return GeneralFailure
+	}
+}
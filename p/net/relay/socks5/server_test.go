@@ -0,0 +1,246 @@
+package socks5_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+	. "github.com/gptlocal/netool/p/net/relay/socks5"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// startSOCKSServer serves a SOCKS5 server relaying through a new local relay server.
+func startSOCKSServer(t *testing.T, auth relay.Authenticator) net.Listener {
+	t.Helper()
+	rln := listen(t)
+	go (&relay.Server{ACL: &relay.ACL{AllowPrivate: true}}).Serve(rln)
+
+	ln := listen(t)
+	srv := &Server{
+		Upstream:      &relay.Client{Addr: rln.Addr().String()},
+		Authenticator: auth,
+	}
+	go srv.Serve(ln)
+	return ln
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln := listen(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestServerConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startSOCKSServer(t, relay.StaticAuthenticator{"alice": "secret"})
+
+	d, err := proxy.SOCKS5("tcp", ln.Addr().String(), &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5: %v", err)
+	}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello socks")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+
+	d, _ = proxy.SOCKS5("tcp", ln.Addr().String(), &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+	if _, err := d.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Error("Dial with a wrong password succeeded")
+	}
+}
+
+func TestServerLongCredentials(t *testing.T) {
+	echo := startEchoServer(t)
+	user, password := strings.Repeat("u", 255), strings.Repeat("p", 255)
+	ln := startSOCKSServer(t, relay.StaticAuthenticator{user: password})
+
+	d, err := proxy.SOCKS5("tcp", ln.Addr().String(), &proxy.Auth{User: user, Password: password}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5: %v", err)
+	}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial with 255-byte credentials: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerDialTimeout(t *testing.T) {
+	// A relay accepting connections but never answering.
+	stuck := listen(t)
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	ln := listen(t)
+	srv := &Server{Upstream: &relay.Client{Addr: stuck.Addr().String()}, DialTimeout: 100 * time.Millisecond}
+	go srv.Serve(ln)
+
+	d, err := proxy.SOCKS5("tcp", ln.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "192.0.2.1:80")
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Dial through a stuck relay succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial through a stuck relay did not time out")
+	}
+}
+
+func TestServerConnectUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	ln := startSOCKSServer(t, nil)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	req := []byte{Version5, 1, MethodNoAuth, Version5, CmdConnect, 0}
+	af := &features.AddrFeature{}
+	af.ParseFrom(closed)
+	ab, _ := af.Encode()
+	conn.Write(append(req, ab...))
+
+	got := make([]byte, 2+3)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got[1] != MethodNoAuth || got[3] != HostUnreachable {
+		t.Errorf("got method %#x and reply %#x, want %#x and %#x", got[1], got[3], MethodNoAuth, HostUnreachable)
+	}
+}
+
+func TestServerBindNotSupported(t *testing.T) {
+	ln := startSOCKSServer(t, nil)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{Version5, 1, MethodNoAuth, Version5, CmdBind, 0, byte(features.AddrIPv4), 0, 0, 0, 0, 0, 0})
+	got := make([]byte, 2+3)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got[3] != CommandNotSupported {
+		t.Errorf("reply = %#x, want %#x", got[3], CommandNotSupported)
+	}
+}
+
+func TestServerUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	ln := startSOCKSServer(t, nil)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{Version5, 1, MethodNoAuth, Version5, CmdUDPAssociate, 0, byte(features.AddrIPv4), 0, 0, 0, 0, 0, 0})
+	got := make([]byte, 2+3+1+4+2)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got[3] != Succeeded {
+		t.Fatalf("reply = %#x, want %#x", got[3], Succeeded)
+	}
+	bnd := &features.AddrFeature{}
+	if err := bnd.Decode(got[5:]); err != nil {
+		t.Fatalf("decode BND.ADDR: %v", err)
+	}
+
+	uc, err := net.Dial("udp", bnd.String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer uc.Close()
+
+	af := &features.AddrFeature{}
+	af.ParseFrom(echo.LocalAddr().String())
+	ab, _ := af.Encode()
+	want := append(append([]byte{0, 0, 0}, ab...), "ping"...)
+	uc.Write(want)
+
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := uc.Read(b)
+	if err != nil {
+		t.Fatalf("read udp: %v", err)
+	}
+	if !bytes.Equal(b[:n], want) {
+		t.Errorf("got datagram %x, want %x", b[:n], want)
+	}
+}
@@ -0,0 +1,190 @@
+// Package socks5 implements a SOCKS5 server (RFC 1928) translating the SOCKS requests into
+// relay requests to an upstream relay server, so that applications configured for SOCKS5
+// can use the relay.
+//
+// The SOCKS5 address encoding (ATYP, DST.ADDR, DST.PORT) is the encoding of features.AddrFeature.
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+const (
+	Version5        = 0x05
+	userAuthVersion = 0x01
+)
+
+// Authentication methods.
+const (
+	MethodNoAuth       uint8 = 0x00
+	MethodUserPass     uint8 = 0x02
+	MethodNoAcceptable uint8 = 0xFF
+)
+
+// Commands.
+const (
+	CmdConnect      uint8 = 0x01
+	CmdBind         uint8 = 0x02
+	CmdUDPAssociate uint8 = 0x03
+)
+
+// Reply codes.
+const (
+	Succeeded               uint8 = 0x00
+	GeneralFailure          uint8 = 0x01
+	NotAllowed              uint8 = 0x02
+	NetworkUnreachable      uint8 = 0x03
+	HostUnreachable         uint8 = 0x04
+	ConnectionRefused       uint8 = 0x05
+	TTLExpired              uint8 = 0x06
+	CommandNotSupported     uint8 = 0x07
+	AddressTypeNotSupported uint8 = 0x08
+)
+
+var (
+	ErrBadVersion = errors.New("socks5: bad version")
+	ErrAuthFailed = errors.New("socks5: authentication failed")
+)
+
+// readMethods reads the version identifier/method selection message:
+//
+//	+-----+----------+----------+
+//	| VER | NMETHODS | METHODS  |
+//	+-----+----------+----------+
+//	|  1  |    1     | 1 to 255 |
+//	+-----+----------+----------+
+func readMethods(r io.Reader) ([]uint8, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != Version5 {
+		return nil, fmt.Errorf("%w %d", ErrBadVersion, header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// readUserPass reads the username/password request of RFC 1929:
+//
+//	+-----+------+----------+------+----------+
+//	| VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+-----+------+----------+------+----------+
+//	|  1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+-----+------+----------+------+----------+
+func readUserPass(r io.Reader) (username, password string, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	if header[0] != userAuthVersion {
+		return "", "", fmt.Errorf("%w %d of the username/password authentication", ErrBadVersion, header[0])
+	}
+	b := make([]byte, int(header[1])+1)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	username = string(b[:header[1]])
+	p := make([]byte, b[header[1]])
+	if _, err = io.ReadFull(r, p); err != nil {
+		return
+	}
+	return username, string(p), nil
+}
+
+// Request is a SOCKS request:
+//
+//	+-----+-----+-------+------+----------+----------+
+//	| VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+//	+-----+-----+-------+------+----------+----------+
+//	|  1  |  1  | X'00' |  1   | Variable |    2     |
+//	+-----+-----+-------+------+----------+----------+
+type Request struct {
+	Cmd  uint8
+	Addr features.AddrFeature
+}
+
+func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
+	var header [3]byte
+	nn, err := io.ReadFull(r, header[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	if header[0] != Version5 {
+		return n, fmt.Errorf("%w %d", ErrBadVersion, header[0])
+	}
+	req.Cmd = header[1]
+
+	nn, err = readAddr(r, &req.Addr)
+	n += int64(nn)
+	return
+}
+
+// readAddr reads an address in the ATYP, ADDR, PORT encoding.
+func readAddr(r io.Reader, af *features.AddrFeature) (int, error) {
+	b := make([]byte, 1, 1+1+0xFF+2)
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return n, err
+	}
+
+	var size int
+	switch features.AddrType(b[0]) {
+	case features.AddrIPv4:
+		size = 4 + 2
+	case features.AddrIPv6:
+		size = 16 + 2
+	case features.AddrDomain:
+		b = b[:2]
+		nn, err := io.ReadFull(r, b[1:])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		size = int(b[1]) + 2
+	default:
+		return n, features.ErrBadAddrType
+	}
+
+	off := len(b)
+	b = b[:off+size]
+	nn, err := io.ReadFull(r, b[off:])
+	n += nn
+	if err != nil {
+		return n, err
+	}
+	return n, af.Decode(b)
+}
+
+// Reply is the reply to a request:
+//
+//	+-----+-----+-------+------+----------+----------+
+//	| VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+//	+-----+-----+-------+------+----------+----------+
+//	|  1  |  1  | X'00' |  1   | Variable |    2     |
+//	+-----+-----+-------+------+----------+----------+
+type Reply struct {
+	Rep  uint8
+	Addr features.AddrFeature // the zero IPv4 address if unset
+}
+
+func (rep *Reply) WriteTo(w io.Writer) (int64, error) {
+	af := rep.Addr
+	if af.AType == 0 {
+		af.AType = features.AddrIPv4
+	}
+	ab, err := af.Encode()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append([]byte{Version5, rep.Rep, 0}, ab...))
+	return int64(n), err
+}
@@ -0,0 +1,170 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+var errFragmented = errors.New("socks5: fragmented datagram")
+
+// parseDatagram parses a UDP request:
+//
+//	+-----+------+------+----------+----------+----------+
+//	| RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+-----+------+------+----------+----------+----------+
+//	|  2  |  1   |  1   | Variable |    2     | Variable |
+//	+-----+------+------+----------+----------+----------+
+//
+// Fragmentation is not supported.
+func parseDatagram(b []byte, af *features.AddrFeature) ([]byte, error) {
+	if len(b) < 3 {
+		return nil, features.ErrShortBuffer
+	}
+	if b[2] != 0 {
+		return nil, errFragmented
+	}
+	n, err := readAddr(bytes.NewReader(b[3:]), af)
+	if err != nil {
+		return nil, err
+	}
+	return b[3+n:], nil
+}
+
+// appendDatagram appends the UDP reply carrying data from af to b.
+func appendDatagram(b []byte, af *features.AddrFeature, data []byte) ([]byte, error) {
+	ab, err := af.Encode()
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, 0, 0, 0)
+	b = append(b, ab...)
+	return append(b, data...), nil
+}
+
+// handleUDPAssociate relays the datagrams of the client through a relay UDP association.
+// The association ends when the client closes conn.
+//
+// The client is the first sender of a datagram from the IP address of conn, or from the
+// address of the request if it is not zero.
+func (s *Server) handleUDPAssociate(conn net.Conn, req *Request) {
+	laddr := &net.UDPAddr{}
+	if ta, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = ta.IP
+	}
+	uc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Printf("socks5: %s: listen udp: %v", conn.RemoteAddr(), err)
+		(&Reply{Rep: GeneralFailure}).WriteTo(conn)
+		return
+	}
+	defer uc.Close()
+
+	ctx, cancel := s.dialContext()
+	pc, err := s.Upstream.ListenPacket(ctx, "udp")
+	cancel()
+	if err != nil {
+		log.Printf("socks5: %s: associate: %v", conn.RemoteAddr(), err)
+		(&Reply{Rep: replyFromError(err)}).WriteTo(conn)
+		return
+	}
+	defer pc.Close()
+
+	rep := &Reply{Rep: Succeeded}
+	rep.Addr.ParseFrom(uc.LocalAddr().String())
+	if _, err := rep.WriteTo(conn); err != nil {
+		log.Printf("socks5: %s: write reply: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	var clientIP net.IP
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = ta.IP
+	}
+	var clientAddr *net.UDPAddr
+	if req.Addr.Port != 0 {
+		clientAddr = &net.UDPAddr{IP: net.ParseIP(req.Addr.Host), Port: int(req.Addr.Port)}
+		if clientAddr.IP == nil || clientAddr.IP.IsUnspecified() {
+			clientAddr.IP = clientIP
+		}
+	}
+
+	errc := make(chan error, 3)
+	go func() {
+		// The client ends the association by closing the TCP connection.
+		_, err := io.Copy(io.Discard, conn)
+		errc <- err
+	}()
+	peer := make(chan *net.UDPAddr, 1)
+	dst := clientAddr
+	go func() {
+		b := netutil.GetDatagramBuffer()
+		defer netutil.PutDatagramBuffer(b)
+		for {
+			n, raddr, err := uc.ReadFromUDP(b)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if clientAddr == nil {
+				if clientIP != nil && !clientIP.Equal(raddr.IP) {
+					continue
+				}
+				clientAddr = raddr
+				peer <- raddr
+			} else if !clientAddr.IP.Equal(raddr.IP) || clientAddr.Port != raddr.Port {
+				continue
+			}
+
+			af := &features.AddrFeature{}
+			data, err := parseDatagram(b[:n], af)
+			if err != nil {
+				log.Printf("socks5: %s: datagram from %s: %v", conn.RemoteAddr(), raddr, err)
+				continue
+			}
+			if _, err := pc.WriteTo(data, &relay.Addr{Net: "udp", Address: af.String()}); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		b := netutil.GetDatagramBuffer()
+		defer netutil.PutDatagramBuffer(b)
+		var out []byte
+		for {
+			n, raddr, err := pc.ReadFrom(b)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if dst == nil {
+				select {
+				case dst = <-peer:
+				default:
+					// The client has not sent a datagram yet, its address is unknown.
+					continue
+				}
+			}
+			af := &features.AddrFeature{}
+			af.ParseFrom(raddr.String())
+			if out, err = appendDatagram(out[:0], af, b[:n]); err != nil {
+				continue
+			}
+			if _, err := uc.WriteToUDP(out, dst); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		log.Printf("socks5: %s: udp association on %s: %v", conn.RemoteAddr(), uc.LocalAddr(), err)
+	}
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Relay status codes carried by Response.Status.
+const (
+	StatusOK                  uint8 = 0x00
+	StatusBadRequest          uint8 = 0x01
+	StatusUnauthorized        uint8 = 0x02
+	StatusForbidden           uint8 = 0x03
+	StatusTimeout             uint8 = 0x04
+	StatusServiceUnavailable  uint8 = 0x05
+	StatusHostUnreachable     uint8 = 0x06
+	StatusNetworkUnreachable  uint8 = 0x07
+	StatusInternalServerError uint8 = 0x08
+	StatusUnsupportedVersion  uint8 = 0x09
+	StatusQuotaExceeded       uint8 = 0x0A
+)
+
+var statusText = map[uint8]string{
+	StatusOK:                  "OK",
+	StatusBadRequest:          "bad request",
+	StatusUnauthorized:        "unauthorized",
+	StatusForbidden:           "forbidden",
+	StatusTimeout:             "timeout",
+	StatusServiceUnavailable:  "service unavailable",
+	StatusHostUnreachable:     "host unreachable",
+	StatusNetworkUnreachable:  "network unreachable",
+	StatusInternalServerError: "internal server error",
+	StatusUnsupportedVersion:  "unsupported version",
+	StatusQuotaExceeded:       "quota exceeded",
+}
+
+// StatusText returns a text for the relay status code. It returns the empty string if the code is unknown.
+func StatusText(code uint8) string {
+	return statusText[code]
+}
+
+// StatusError is returned by the client when the server rejects a request.
+type StatusError struct {
+	Status uint8
+}
+
+func (e *StatusError) Error() string {
+	if text := StatusText(e.Status); text != "" {
+		return "relay: " + text
+	}
+	return fmt.Sprintf("relay: unknown status %#x", e.Status)
+}
+
+// Timeout reports whether the server gave up on the target because of a timeout.
+func (e *StatusError) Timeout() bool {
+	return e.Status == StatusTimeout
+}
+
+// StatusFromError maps an error returned while dialing or listening to a relay status code.
+func StatusFromError(err error) uint8 {
+	if err == nil {
+		return StatusOK
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return StatusTimeout
+	}
+	if errors.Is(err, ErrDestinationDenied) {
+		return StatusForbidden
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return StatusTimeout
+		}
+		return StatusHostUnreachable
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ENETUNREACH, syscall.ENETDOWN:
+			return StatusNetworkUnreachable
+		case syscall.EHOSTUNREACH, syscall.EHOSTDOWN, syscall.ECONNREFUSED, syscall.ECONNRESET:
+			return StatusHostUnreachable
+		case syscall.ETIMEDOUT:
+			return StatusTimeout
+		case syscall.EACCES, syscall.EPERM:
+			return StatusForbidden
+		case syscall.EADDRINUSE, syscall.EADDRNOTAVAIL:
+			return StatusServiceUnavailable
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return StatusTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return StatusHostUnreachable
+	}
+	return StatusServiceUnavailable
+}
@@ -0,0 +1,65 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+)
+
+func TestStatusFromError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want uint8
+	}{
+		{nil, StatusOK},
+		{context.DeadlineExceeded, StatusTimeout},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), StatusTimeout},
+		{&net.DNSError{Err: "no such host", Name: "nx.invalid", IsNotFound: true}, StatusHostUnreachable},
+		{&net.DNSError{Err: "i/o timeout", Name: "slow.invalid", IsTimeout: true}, StatusTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, StatusHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, StatusNetworkUnreachable},
+		{&net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EACCES)}, StatusForbidden},
+		{&net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, StatusServiceUnavailable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("unknown")}, StatusHostUnreachable},
+		{errors.New("unknown"), StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if got := StatusFromError(tt.err); got != tt.want {
+			t.Errorf("StatusFromError(%v) = %#x, want %#x", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClientStatusError(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+
+	ln := startRelayServer(t, &Server{Authenticator: StaticAuthenticator{"alice": "secret"}})
+
+	tests := []struct {
+		client  *Client
+		address string
+		status  uint8
+	}{
+		{&Client{Addr: ln.Addr().String(), Username: "alice", Password: "wrong"}, closed, StatusUnauthorized},
+		{&Client{Addr: ln.Addr().String(), Username: "alice", Password: "secret"}, closed, StatusHostUnreachable},
+	}
+	for _, tt := range tests {
+		_, err := tt.client.Dial("tcp", tt.address)
+		var se *StatusError
+		if !errors.As(err, &se) {
+			t.Errorf("Dial error = %v, want a *StatusError", err)
+			continue
+		}
+		if se.Status != tt.status {
+			t.Errorf("Dial status = %#x (%v), want %#x", se.Status, se, tt.status)
+		}
+	}
+}
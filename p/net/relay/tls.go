@@ -0,0 +1,15 @@
+package relay
+
+import "crypto/tls"
+
+// certUser returns the username of the verified client certificate of cs, or "" if there is none.
+func (s *Server) certUser(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	if s.ClientCertUser != nil {
+		return s.ClientCertUser(cert)
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,120 @@
+package relay_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/tlstest"
+)
+
+func checkEcho(t *testing.T, c *Client, address string) error {
+	t.Helper()
+	conn, err := c.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := []byte("hello over tls")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+	return nil
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "relay test CA")
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{
+		Authenticator: StaticAuthenticator{"alice": "secret"},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.ServerCert(t, "127.0.0.1")},
+		},
+	})
+
+	c := &Client{
+		Addr:      ln.Addr().String(),
+		Username:  "alice",
+		Password:  "secret",
+		TLSConfig: &tls.Config{RootCAs: ca.Pool()},
+	}
+	if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// The server certificate is not trusted.
+	c.TLSConfig = &tls.Config{RootCAs: tlstest.NewCA(t, "other CA").Pool()}
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial with an untrusted server certificate succeeded")
+	}
+
+	// The server does not speak plaintext.
+	c.TLSConfig = nil
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial without TLS succeeded")
+	}
+}
+
+func TestClientMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "relay test CA")
+	echo := startEchoServer(t)
+
+	var user atomic.Value
+	ln := startRelayServer(t, &Server{
+		Authenticator: AuthenticatorFunc(func(ctx context.Context, username, password string) bool {
+			return false
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.ServerCert(t, "127.0.0.1")},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.Pool(),
+		},
+		ClientCertUser: func(cert *x509.Certificate) string {
+			user.Store(cert.Subject.CommonName)
+			return cert.Subject.CommonName
+		},
+	})
+
+	for _, useMux := range []bool{false, true} {
+		c := &Client{
+			Addr: ln.Addr().String(),
+			Mux:  useMux,
+			TLSConfig: &tls.Config{
+				RootCAs:      ca.Pool(),
+				Certificates: []tls.Certificate{ca.ClientCert(t, "bob")},
+			},
+		}
+		if err := checkEcho(t, c, echo.Addr().String()); err != nil {
+			t.Fatalf("Dial with client certificate (mux %v): %v", useMux, err)
+		}
+		if got := user.Load(); got != "bob" {
+			t.Errorf("authenticated user = %v, want bob", got)
+		}
+		c.Close()
+	}
+
+	// Without a certificate, the request falls back to the Authenticator.
+	c := &Client{
+		Addr:      ln.Addr().String(),
+		TLSConfig: &tls.Config{RootCAs: ca.Pool()},
+	}
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial without client certificate succeeded")
+	}
+
+	// A certificate issued by another CA is rejected during the handshake.
+	c.TLSConfig.Certificates = []tls.Certificate{tlstest.NewCA(t, "other CA").ClientCert(t, "mallory")}
+	if err := checkEcho(t, c, echo.Addr().String()); err == nil {
+		t.Error("Dial with an untrusted client certificate succeeded")
+	}
+}
@@ -0,0 +1,248 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/mux"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+// connector is a registered endpoint of a tunnel, the server opens a stream on its
+// session for every client routed to it.
+type connector struct {
+	id   features.ConnectorID
+	tid  features.TunnelID
+	user string
+	sess *mux.Session // nil until the connector has been answered, protected by the registry
+}
+
+type tunnel struct {
+	private    bool
+	owner      string // the user of the first connector
+	connectors []*connector
+	next       int
+}
+
+// tunnelRegistry routes clients to the connectors registered by TunnelID.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[[16]byte]*tunnel
+}
+
+// add registers c, it fails if the tunnel is already registered with another privacy or by
+// another user. The connector is not routed to until start is called.
+func (r *tunnelRegistry) add(c *connector) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tunnels == nil {
+		r.tunnels = make(map[[16]byte]*tunnel)
+	}
+	t := r.tunnels[c.tid.ID()]
+	if t == nil {
+		t = &tunnel{private: c.tid.IsPrivate(), owner: c.user}
+		r.tunnels[c.tid.ID()] = t
+	}
+	if t.private != c.tid.IsPrivate() || t.owner != c.user {
+		return false
+	}
+	t.connectors = append(t.connectors, c)
+	return true
+}
+
+// start routes the clients of the tunnel to c over sess.
+func (r *tunnelRegistry) start(c *connector, sess *mux.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.sess = sess
+}
+
+func (r *tunnelRegistry) del(c *connector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.tunnels[c.tid.ID()]
+	if t == nil {
+		return
+	}
+	for i, cc := range t.connectors {
+		if cc == c {
+			t.connectors = append(t.connectors[:i], t.connectors[i+1:]...)
+			break
+		}
+	}
+	if len(t.connectors) == 0 {
+		delete(r.tunnels, c.tid.ID())
+	}
+}
+
+// pick selects a connector of the tunnel in round-robin order.
+//
+// A private tunnel is only visible to the requests flagged with TunnelPrivate,
+// and the connector network must match the requested one.
+func (r *tunnelRegistry) pick(tid features.TunnelID, udp bool) *connector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.tunnels[tid.ID()]
+	if t == nil || t.private != tid.IsPrivate() {
+		return nil
+	}
+	for range t.connectors {
+		c := t.connectors[t.next%len(t.connectors)]
+		t.next++
+		if c.id.IsUDP() == udp && c.sess != nil && !c.sess.IsClosed() {
+			return c
+		}
+	}
+	return nil
+}
+
+// handleConnector registers the connection of a BIND request carrying a TunnelFeature
+// as a tunnel connector. The response carries the assigned ConnectorID.
+//
+// A tunnel belongs to the user of its first connector until its last connector is gone,
+// the connectors of other users are rejected.
+func (s *Server) handleConnector(ctx context.Context, conn net.Conn, req *Request, tf *features.TunnelFeature) {
+	network, _ := targetOf(req)
+	if network != "tcp" && network != "udp" {
+		log.Printf("relay: %s: unsupported network %s", conn.RemoteAddr(), network)
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+
+	var v [16]byte
+	if _, err := rand.Read(v[:]); err != nil {
+		writeResponse(conn, req.Version, StatusInternalServerError)
+		return
+	}
+	cid := features.NewConnectorID(v[:])
+	if network == "udp" {
+		cid = features.NewUDPConnectorID(v[:])
+	}
+
+	c := &connector{
+		id:   cid,
+		tid:  tf.TunnelID(),
+		user: userFromContext(ctx),
+	}
+	if c.tid.IsZero() {
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+	if !s.tunnels.add(c) {
+		log.Printf("relay: %s: tunnel %s is registered with another privacy or by another user", conn.RemoteAddr(), c.tid)
+		writeResponse(conn, req.Version, StatusForbidden)
+		return
+	}
+	defer s.tunnels.del(c)
+
+	// The session starts once the response is written, its frames must not precede it.
+	err := writeResponse(conn, req.Version, StatusOK, &features.TunnelFeature{ID: cid.ID(), Flag: uint32(cid.Flag())})
+	if err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+	sess := mux.Server(conn, nil)
+	defer sess.Close()
+	s.tunnels.start(c, sess)
+	log.Printf("relay: %s: connector %s registered for tunnel %s", conn.RemoteAddr(), cid, c.tid)
+
+	<-sess.CloseChan()
+	log.Printf("relay: %s: connector %s unregistered from tunnel %s", conn.RemoteAddr(), cid, c.tid)
+}
+
+// handleTunnelConnect splices the client to a stream opened on one of the tunnel connectors.
+//
+// Each stream starts with a Response carrying the AddrFeature of the client, followed by
+// the AddrFeature of the requested destination if any.
+func (s *Server) handleTunnelConnect(conn net.Conn, req *Request, tf *features.TunnelFeature) {
+	network, address := targetOf(req)
+
+	c := s.tunnels.pick(tf.TunnelID(), network == "udp")
+	if c == nil {
+		log.Printf("relay: %s: no connector available for tunnel %s/%s", conn.RemoteAddr(), tf.TunnelID(), network)
+		writeResponse(conn, req.Version, StatusServiceUnavailable)
+		return
+	}
+
+	st, err := c.sess.OpenStream()
+	if err != nil {
+		log.Printf("relay: %s: open stream to connector %s: %v", conn.RemoteAddr(), c.id, err)
+		writeResponse(conn, req.Version, StatusServiceUnavailable)
+		return
+	}
+	defer st.Close()
+
+	src := &features.AddrFeature{}
+	src.ParseFrom(conn.RemoteAddr().String())
+	fs := []features.Feature{src}
+	if address != "" {
+		dst := &features.AddrFeature{}
+		dst.ParseFrom(address)
+		fs = append(fs, dst)
+	}
+	if err := writeResponse(st, req.Version, StatusOK, fs...); err != nil {
+		writeResponse(conn, req.Version, StatusServiceUnavailable)
+		return
+	}
+
+	if err := writeResponse(conn, req.Version, StatusOK); err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := netutil.Transport(conn, st); err != nil {
+		log.Printf("relay: %s <-> connector %s: %v", conn.RemoteAddr(), c.id, err)
+	}
+}
+
+// ListenTunnel registers the client as a connector of the tunnel c.Tunnel, the returned
+// listener accepts the connections the server routes to this connector.
+//
+// For the udp network, the accepted connections carry datagrams and implement net.PacketConn.
+// The listener address is the ConnectorID assigned by the server.
+func (c *Client) ListenTunnel(ctx context.Context, network string) (net.Listener, error) {
+	nid := features.NetworkTCP
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		nid = features.NetworkUDP
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	tf := &features.TunnelFeature{ID: c.Tunnel.ID(), Flag: uint32(c.Tunnel.Flag())}
+	req := c.newRequest(CmdBind, tf, &features.NetworkFeature{Network: nid})
+
+	conn, resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	ln := &bindListener{
+		sess: mux.Client(conn, nil),
+		addr: &Addr{Net: network},
+		udp:  nid == features.NetworkUDP,
+	}
+	for _, f := range resp.Features {
+		if f, ok := f.(*features.TunnelFeature); ok {
+			ln.addr.Address = f.ConnectorID().String()
+		}
+	}
+	return ln, nil
+}
+
+func tunnelOf(req *Request) *features.TunnelFeature {
+	for _, f := range req.Features {
+		if f, ok := f.(*features.TunnelFeature); ok {
+			return f
+		}
+	}
+	return nil
+}
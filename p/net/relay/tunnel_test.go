@@ -0,0 +1,198 @@
+package relay_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+var testTunnelID = []byte{
+	0x3b, 0x4c, 0x56, 0x0e, 0x0f, 0x1a, 0x4d, 0x7b,
+	0x9b, 0x2a, 0x27, 0x1d, 0x7a, 0x3e, 0x10, 0x01,
+}
+
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestTunnelConnect(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	tid := features.NewTunnelID(testTunnelID)
+
+	connector := &Client{Addr: ln.Addr().String(), Tunnel: tid}
+	tln, err := connector.ListenTunnel(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("ListenTunnel: %v", err)
+	}
+	defer tln.Close()
+
+	dst := make(chan net.Addr, 1)
+	go func() {
+		conn, err := tln.Accept()
+		if err != nil {
+			return
+		}
+		dst <- conn.LocalAddr()
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	c := &Client{Addr: ln.Addr().String(), Tunnel: tid}
+	conn, err := c.Dial("tcp", "internal.service:8080")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("through the tunnel")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+	if addr := <-dst; addr.String() != "internal.service:8080" {
+		t.Errorf("connector conn LocalAddr = %v, want %v", addr, "internal.service:8080")
+	}
+}
+
+func TestTunnelOwner(t *testing.T) {
+	ln := startRelayServer(t, &Server{Authenticator: StaticAuthenticator{"alice": "a", "bob": "b"}})
+	tid := features.NewTunnelID(testTunnelID)
+
+	alice := &Client{Addr: ln.Addr().String(), Tunnel: tid, Username: "alice", Password: "a"}
+	tln, err := alice.ListenTunnel(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("ListenTunnel as alice: %v", err)
+	}
+	defer tln.Close()
+
+	bob := &Client{Addr: ln.Addr().String(), Tunnel: tid, Username: "bob", Password: "b"}
+	if bln, err := bob.ListenTunnel(context.Background(), "tcp"); err == nil {
+		bln.Close()
+		t.Error("bob registered a connector for the tunnel of alice")
+	}
+
+	// Alice may register more connectors.
+	tln2, err := alice.ListenTunnel(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("second ListenTunnel as alice: %v", err)
+	}
+	tln2.Close()
+}
+
+func TestTunnelNoConnector(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String(), Tunnel: features.NewTunnelID(testTunnelID)}
+	if conn, err := c.Dial("tcp", "internal.service:8080"); err == nil {
+		conn.Close()
+		t.Fatal("Dial to a tunnel without connectors succeeded")
+	}
+}
+
+func TestTunnelPrivate(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	private := features.NewPrivateTunnelID(testTunnelID)
+
+	connector := &Client{Addr: ln.Addr().String(), Tunnel: private}
+	tln, err := connector.ListenTunnel(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("ListenTunnel: %v", err)
+	}
+	defer tln.Close()
+	go serveEcho(tln)
+
+	public := &Client{Addr: ln.Addr().String(), Tunnel: features.NewTunnelID(testTunnelID)}
+	if conn, err := public.Dial("tcp", "internal.service:8080"); err == nil {
+		conn.Close()
+		t.Error("public Dial to a private tunnel succeeded")
+	}
+	if _, err := public.ListenTunnel(context.Background(), "tcp"); err == nil {
+		t.Error("public connector registered for a private tunnel")
+	}
+
+	c := &Client{Addr: ln.Addr().String(), Tunnel: private}
+	conn, err := c.Dial("tcp", "internal.service:8080")
+	if err != nil {
+		t.Fatalf("private Dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestTunnelUDPConnector(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	tid := features.NewTunnelID(testTunnelID)
+
+	tcpConnector := &Client{Addr: ln.Addr().String(), Tunnel: tid}
+	tcpln, err := tcpConnector.ListenTunnel(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("ListenTunnel tcp: %v", err)
+	}
+	defer tcpln.Close()
+	go serveEcho(tcpln)
+
+	c := &Client{Addr: ln.Addr().String(), Tunnel: tid}
+	if conn, err := c.Dial("udp", "internal.dns:53"); err == nil {
+		conn.Close()
+		t.Error("udp Dial routed to a tcp connector")
+	}
+
+	udpConnector := &Client{Addr: ln.Addr().String(), Tunnel: tid}
+	udpln, err := udpConnector.ListenTunnel(context.Background(), "udp")
+	if err != nil {
+		t.Fatalf("ListenTunnel udp: %v", err)
+	}
+	defer udpln.Close()
+	go func() {
+		conn, err := udpln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		pc, ok := conn.(net.PacketConn)
+		if !ok {
+			t.Errorf("udp connector conn %T does not implement net.PacketConn", conn)
+			return
+		}
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	conn, err := c.Dial("udp", "internal.dns:53")
+	if err != nil {
+		t.Fatalf("udp Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("query"))
+	b := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(b[:n]) != "query" {
+		t.Errorf("got %q, want %q", b[:n], "query")
+	}
+}
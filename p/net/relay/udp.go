@@ -0,0 +1,348 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/internal/netutil"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+const (
+	maxDatagramSize = netutil.MaxDatagramSize
+
+	// maxResolved is the number of destinations an association caches the resolution of.
+	maxResolved = 256
+
+	// resolveTimeout is the maximum duration of the lookup of a destination.
+	resolveTimeout = 5 * time.Second
+)
+
+// PacketListener creates the packet connections for ASSOCIATE requests,
+// net.ListenConfig satisfies this interface.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Datagram is a UDP packet carried over a relay stream.
+//
+// Protocol spec:
+//
+//	+------+------+----------+----------+
+//	| DLEN | ALEN |   ADDR   |   DATA   |
+//	+------+------+----------+----------+
+//	|  2   |  1   | Variable | Variable |
+//	+------+------+----------+----------+
+//
+//	DLEN - length of DATA, 2 bytes.
+//	ALEN - length of ADDR, 1 byte.
+//	ADDR - destination address for client packets or source address for server packets,
+//	       in the AddrFeature encoding (ATYP, ADDR, PORT).
+//	DATA - packet payload.
+type Datagram struct {
+	Addr features.AddrFeature
+	Data []byte
+}
+
+func (d *Datagram) ReadFrom(r io.Reader) (n int64, err error) {
+	var header [3]byte
+	nn, err := io.ReadFull(r, header[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	dlen := int(binary.BigEndian.Uint16(header[:2]))
+	alen := int(header[2])
+
+	b := make([]byte, alen+dlen)
+	nn, err = io.ReadFull(r, b)
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	if err = d.Addr.Decode(b[:alen]); err != nil {
+		return
+	}
+	d.Data = b[alen:]
+	return
+}
+
+func (d *Datagram) WriteTo(w io.Writer) (n int64, err error) {
+	if len(d.Data) > maxDatagramSize {
+		return 0, errors.New("datagram maximum length exceeded")
+	}
+	ab, err := d.Addr.Encode()
+	if err != nil {
+		return
+	}
+	if len(ab) > 0xFF {
+		return 0, errors.New("datagram address too long")
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(d.Data)))
+	buf.WriteByte(uint8(len(ab)))
+	buf.Write(ab)
+	buf.Write(d.Data)
+
+	return buf.WriteTo(w)
+}
+
+// handleConnectUDP relays the datagrams between conn and the connected UDP socket cc.
+func (s *Server) handleConnectUDP(conn net.Conn, cc net.Conn, target *features.AddrFeature) {
+	errc := make(chan error, 2)
+	go func() {
+		for {
+			dgram := &Datagram{}
+			if _, err := dgram.ReadFrom(conn); err != nil {
+				errc <- err
+				return
+			}
+			if _, err := cc.Write(dgram.Data); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		b := netutil.GetDatagramBuffer()
+		defer netutil.PutDatagramBuffer(b)
+		for {
+			n, err := cc.Read(b)
+			if err != nil {
+				errc <- err
+				return
+			}
+			dgram := &Datagram{Addr: *target, Data: b[:n]}
+			if _, err := dgram.WriteTo(conn); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF {
+		log.Printf("relay: %s <-> %s/udp: %v", conn.RemoteAddr(), target, err)
+	}
+}
+
+// handleAssociate creates a UDP association: the client sends datagrams to any destination
+// through conn, and the datagrams received by the server are sent back with their source address.
+//
+// Datagrams to the destinations denied by the ACL are dropped, and so are the datagrams
+// received from the addresses the client has not sent to.
+func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) {
+	network, _ := targetOf(req)
+	if network != "udp" {
+		log.Printf("relay: %s: unsupported network %s", conn.RemoteAddr(), network)
+		writeResponse(conn, req.Version, StatusBadRequest)
+		return
+	}
+
+	acl := s.acl()
+	user := userFromContext(ctx)
+
+	pc, err := s.packetListener().ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		log.Printf("relay: %s: listen udp: %v", conn.RemoteAddr(), err)
+		writeResponse(conn, req.Version, StatusFromError(err))
+		return
+	}
+	defer pc.Close()
+
+	af := &features.AddrFeature{}
+	af.ParseFrom(pc.LocalAddr().String())
+	if err := writeResponse(conn, req.Version, StatusOK, af); err != nil {
+		log.Printf("relay: %s: write response: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// The lookups are canceled when the association ends.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var peersMu sync.Mutex
+	peers := make(map[string]bool) // the addresses the client has sent to
+
+	errc := make(chan error, 2)
+	go func() {
+		resolved := make(map[string]*net.UDPAddr) // nil for the denied destinations
+		for {
+			dgram := &Datagram{}
+			if _, err := dgram.ReadFrom(conn); err != nil {
+				errc <- err
+				return
+			}
+			dst := dgram.Addr.String()
+			raddr, ok := resolved[dst]
+			if !ok {
+				lctx, lcancel := context.WithTimeout(ctx, resolveTimeout)
+				ips, err := resolveAllowed(lctx, acl, user, dgram.Addr.Host, dgram.Addr.Port)
+				lcancel()
+				if err != nil && !errors.Is(err, ErrDestinationDenied) {
+					log.Printf("relay: %s: resolve %s: %v", conn.RemoteAddr(), dst, err)
+					continue
+				}
+				if err == nil {
+					raddr = &net.UDPAddr{IP: ips[0], Port: int(dgram.Addr.Port)}
+				}
+				if len(resolved) >= maxResolved {
+					clear(resolved)
+				}
+				resolved[dst] = raddr
+			}
+			if raddr == nil {
+				log.Printf("relay: %s: datagram to %s denied", conn.RemoteAddr(), dst)
+				continue
+			}
+
+			key := peerKey(raddr)
+			peersMu.Lock()
+			peers[key] = true
+			peersMu.Unlock()
+			if _, err := pc.WriteTo(dgram.Data, raddr); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		b := netutil.GetDatagramBuffer()
+		defer netutil.PutDatagramBuffer(b)
+		for {
+			n, raddr, err := pc.ReadFrom(b)
+			if err != nil {
+				errc <- err
+				return
+			}
+			peersMu.Lock()
+			known := peers[peerKey(raddr)]
+			peersMu.Unlock()
+			if !known {
+				continue
+			}
+			dgram := &Datagram{Data: b[:n]}
+			dgram.Addr.ParseFrom(raddr.String())
+			if _, err := dgram.WriteTo(conn); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF {
+		log.Printf("relay: %s: udp association on %s: %v", conn.RemoteAddr(), pc.LocalAddr(), err)
+	}
+}
+
+// peerKey returns the key of addr in the peers of an association, the IPv4-mapped IPv6
+// addresses are keyed as IPv4 addresses.
+func peerKey(addr net.Addr) string {
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()
+	}
+	return addr.String()
+}
+
+func (s *Server) packetListener() PacketListener {
+	if s.PacketListener != nil {
+		return s.PacketListener
+	}
+	return &net.ListenConfig{}
+}
+
+// ListenPacket asks the relay server for a UDP association, the returned net.PacketConn
+// sends and receives datagrams through the server.
+//
+// The context only covers the ASSOCIATE handshake.
+func (c *Client) ListenPacket(ctx context.Context, network string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	req := c.newRequest(CmdAssociate|FUDP, &features.NetworkFeature{Network: features.NetworkUDP})
+	conn, resp, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	pc := &packetConn{Conn: conn, laddr: &Addr{Net: network}}
+	for _, f := range resp.Features {
+		if f, ok := f.(*features.AddrFeature); ok {
+			pc.laddr.Address = f.String()
+		}
+	}
+	return pc, nil
+}
+
+// packetConn is the client side of a UDP relay, it implements both net.Conn and net.PacketConn.
+type packetConn struct {
+	net.Conn
+
+	laddr *Addr
+	raddr net.Addr // set for connected sockets only
+
+	rmu sync.Mutex // serializes datagram reads
+	wmu sync.Mutex // serializes datagram writes
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, &net.OpError{Op: "write", Net: c.laddr.Net, Source: c.laddr, Err: errors.New("destination address required")}
+	}
+	return c.WriteTo(b, c.raddr)
+}
+
+// ReadFrom reads a datagram, the payload exceeding len(b) is discarded.
+func (c *packetConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	dgram := &Datagram{}
+	if _, err = dgram.ReadFrom(c.Conn); err != nil {
+		return
+	}
+	n = copy(b, dgram.Data)
+	addr = &Addr{Net: c.laddr.Net, Address: dgram.Addr.String()}
+	if ip := net.ParseIP(dgram.Addr.Host); ip != nil {
+		addr = &net.UDPAddr{IP: ip, Port: int(dgram.Addr.Port)}
+	}
+	return
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dgram := &Datagram{Data: b}
+	if err := dgram.Addr.ParseFrom(addr.String()); err != nil {
+		return 0, err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := dgram.WriteTo(c.Conn); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
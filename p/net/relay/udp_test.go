@@ -0,0 +1,184 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	in := &Datagram{
+		Addr: features.AddrFeature{AType: features.AddrDomain, Host: "example.com", Port: 53},
+		Data: []byte("query"),
+	}
+	var buf bytes.Buffer
+	if _, err := in.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	out := &Datagram{}
+	if _, err := out.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if out.Addr != in.Addr || !bytes.Equal(out.Data, in.Data) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestDatagramLongAddress(t *testing.T) {
+	host := strings.Repeat("a", 253)
+	in := &Datagram{Addr: features.AddrFeature{AType: features.AddrDomain, Host: host, Port: 53}}
+	var buf bytes.Buffer
+	if _, err := in.WriteTo(&buf); err == nil {
+		t.Error("WriteTo of a 253-byte domain succeeded")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteTo wrote %d bytes after failing", buf.Len())
+	}
+}
+
+func TestClientListenPacketLargeDatagram(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	pc, err := c.ListenPacket(context.Background(), "udp")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	msg := bytes.Repeat([]byte("x"), 48*1024)
+	if _, err := pc.WriteTo(msg, echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	b := make([]byte, 64*1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if n != len(msg) {
+		t.Errorf("got a datagram of %d bytes, want %d", n, len(msg))
+	}
+}
+
+func TestClientDialUDP(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	conn, err := c.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(net.PacketConn); !ok {
+		t.Errorf("udp conn %T does not implement net.PacketConn", conn)
+	}
+
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		b := make([]byte, 16)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if string(b[:n]) != msg {
+			t.Errorf("got %q, want %q", b[:n], msg)
+		}
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	echo1 := startUDPEchoServer(t)
+	echo2 := startUDPEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	pc, err := c.ListenPacket(context.Background(), "udp")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	for _, echo := range []net.PacketConn{echo1, echo2} {
+		if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		b := make([]byte, 16)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		if string(b[:n]) != "ping" {
+			t.Errorf("got %q, want %q", b[:n], "ping")
+		}
+		if addr.String() != echo.LocalAddr().String() {
+			t.Errorf("source address = %v, want %v", addr, echo.LocalAddr())
+		}
+	}
+}
+
+func TestServerAssociateDropsUnknownPeers(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+	c := &Client{Addr: ln.Addr().String()}
+
+	pc, err := c.ListenPacket(context.Background(), "udp")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	// A peer the client never sent to.
+	stranger, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer stranger.Close()
+	stranger.Write([]byte("spam"))
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	b := make([]byte, 16)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if string(b[:n]) != "ping" || addr.String() != echo.LocalAddr().String() {
+		t.Errorf("got %q from %v, want %q from %v", b[:n], addr, "ping", echo.LocalAddr())
+	}
+}
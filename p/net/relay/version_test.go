@@ -0,0 +1,169 @@
+package relay_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/gptlocal/netool/p/net/relay"
+	"github.com/gptlocal/netool/p/net/relay/features"
+)
+
+func TestRequestVersion2RoundTrip(t *testing.T) {
+	req := connectRequest("example.com:443")
+	req.Version = Version2
+	req.Features = append(req.Features, &features.UnknownFeature{FeatureType: 0x7e, Data: []byte("optional")})
+
+	var buf bytes.Buffer
+	if _, err := req.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	encoded := buf.Bytes()
+	if encoded[0] != Version2 || encoded[2] != 0 || encoded[3] != 0 {
+		t.Fatalf("header = %x, want version 2 with a 4-byte features length", encoded[:6])
+	}
+
+	got := &Request{}
+	if _, err := got.ReadFrom(bytes.NewReader(encoded)); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if got.Version != Version2 || got.Cmd != CmdConnect || len(got.Features) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	if af, ok := got.Features[0].(*features.AddrFeature); !ok || af.String() != "example.com:443" {
+		t.Errorf("Features[0] = %v, want AddrFeature example.com:443", got.Features[0])
+	}
+	if uf, ok := got.Features[1].(*features.UnknownFeature); !ok || string(uf.Data) != "optional" {
+		t.Errorf("Features[1] = %v, want the optional unknown feature", got.Features[1])
+	}
+}
+
+func TestRequestVersion2UnknownCritical(t *testing.T) {
+	req := connectRequest("example.com:443")
+	req.Version = Version2
+	req.Features = append(req.Features, &features.UnknownFeature{
+		FeatureType: 0x7e,
+		Flag:        features.FlagCritical,
+		Data:        []byte("must understand"),
+	})
+
+	var buf bytes.Buffer
+	req.WriteTo(&buf)
+	_, err := (&Request{}).ReadFrom(&buf)
+	if !errors.Is(err, features.ErrUnsupportedCritical) {
+		t.Errorf("ReadFrom error = %v, want %v", err, features.ErrUnsupportedCritical)
+	}
+}
+
+func TestRequestVersion2KnownFeatureFlags(t *testing.T) {
+	req := connectRequest("example.com:443")
+	req.Version = Version2
+	req.Features[0].(features.FlaggedFeature).SetFlags(features.FlagCritical)
+
+	var buf bytes.Buffer
+	if _, err := req.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	got := &Request{}
+	if _, err := got.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if flag := features.FlagsOf(got.Features[0]); flag != features.FlagCritical {
+		t.Fatalf("FlagsOf(Features[0]) = %#x, want %#x", flag, features.FlagCritical)
+	}
+
+	// the flags survive a re-encode
+	buf.Reset()
+	if _, err := got.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	again := &Request{}
+	if _, err := again.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if flag := features.FlagsOf(again.Features[0]); flag != features.FlagCritical {
+		t.Errorf("FlagsOf(Features[0]) after re-encode = %#x, want %#x", flag, features.FlagCritical)
+	}
+}
+
+func TestRequestVersion2FeaturesTooLong(t *testing.T) {
+	// version, cmd and a features length of 1MB, without the features
+	msg := []byte{Version2, byte(CmdConnect), 0x00, 0x10, 0x00, 0x00}
+	_, err := (&Request{}).ReadFrom(bytes.NewReader(msg))
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadFrom error = %v, want the features length rejected", err)
+	}
+}
+
+func TestServerRejectsUnknownVersion(t *testing.T) {
+	ln := startRelayServer(t, &Server{})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0x07, byte(CmdConnect), 0, 0})
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Version != Version1 || resp.Status != StatusUnsupportedVersion {
+		t.Fatalf("response = %+v, want a Version1 unsupported version response", resp)
+	}
+	if len(resp.Features) != 1 {
+		t.Fatalf("response features = %v, want a VersionFeature", resp.Features)
+	}
+	vf, ok := resp.Features[0].(*features.VersionFeature)
+	if !ok || !bytes.Equal(vf.Versions, []uint8{Version2, Version1}) {
+		t.Errorf("advertised versions = %v, want [2 1]", resp.Features[0])
+	}
+}
+
+func TestClientVersion2(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+	req := connectRequest(echo.Addr().String())
+	req.Version = Version2
+	req.WriteTo(conn)
+	resp := &Response{}
+	if _, err := resp.ReadFrom(conn); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.Version != Version2 || resp.Status != StatusOK {
+		t.Errorf("response = %+v, want a Version2 OK response", resp)
+	}
+
+	c := &Client{Addr: ln.Addr().String(), Version: Version2}
+	cc, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	cc.Close()
+}
+
+func TestClientVersionFallback(t *testing.T) {
+	echo := startEchoServer(t)
+	ln := startRelayServer(t, &Server{Versions: []uint8{Version1}})
+
+	c := &Client{Addr: ln.Addr().String(), Version: Version2}
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("v1"))
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "v1" {
+		t.Errorf("echo = %q, %v; want %q", got, err, "v1")
+	}
+}
@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn carries a byte stream in the binary messages of a WebSocket connection (RFC 6455).
+// The addresses are the ones of the underlying connection, not the WebSocket URLs.
+type wsConn struct {
+	*websocket.Conn
+	laddr net.Addr
+	raddr net.Addr
+}
+
+func newWSConn(ws *websocket.Conn, laddr, raddr net.Addr) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, laddr: laddr, raddr: raddr}
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// headerContains reports whether the comma-separated header name contains token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectProtocol answers the relay subprotocol if the client offers it, any Origin is accepted.
+func selectProtocol(config *websocket.Config, r *http.Request) error {
+	offered := config.Protocol
+	config.Protocol = nil
+	if slices.Contains(offered, relayProtocol) {
+		config.Protocol = []string{relayProtocol}
+	}
+	return nil
+}
+
+// serveWebSocket completes the WebSocket opening handshake of r and serves the relay
+// connection carried by it. The handshake errors are answered by the websocket package.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Hijacker); !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("relay: %s: websocket: connection cannot be hijacked", r.RemoteAddr)
+		return
+	}
+
+	var laddr net.Addr = &Addr{Net: "tcp"}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		laddr = addr
+	}
+	raddr := &Addr{Net: "tcp", Address: r.RemoteAddr}
+	websocket.Server{
+		Handshake: selectProtocol,
+		Handler: func(ws *websocket.Conn) {
+			conn := newWSConn(ws, laddr, raddr)
+			defer conn.Close()
+			s.serveConn(conn, r.TLS)
+		},
+	}.ServeHTTP(w, r)
+}
+
+// dialWebSocket performs the WebSocket opening handshake for u over conn,
+// the handshake is aborted when ctx is done.
+func dialWebSocket(ctx context.Context, conn net.Conn, u *url.URL) (_ net.Conn, err error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() {
+			err = ctx.Err()
+		}
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	location := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if location.Path == "" {
+		location.Path = "/"
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == SchemeWSS {
+		origin.Scheme = "https"
+	}
+	config := &websocket.Config{
+		Location: location,
+		Origin:   origin,
+		Protocol: []string{relayProtocol},
+		Version:  websocket.ProtocolVersionHybi13,
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
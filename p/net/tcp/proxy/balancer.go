@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gptlocal/netool/w/grpc/backoff"
+)
+
+// Balancing strategies of Route.Balance.
+const (
+	RoundRobin     = "round_robin"
+	LeastConn      = "least_conn"
+	PowerOfTwo     = "p2c"  // the less loaded of two random upstreams
+	ConsistentHash = "hash" // by client IP
+)
+
+const (
+	defaultMaxFails = 3
+	hashReplicas    = 100 // virtual nodes of an upstream on the hash ring
+)
+
+// upstream is an upstream address of a route, with its passive health state.
+type upstream struct {
+	addr   string
+	active atomic.Int64 // connections in progress
+
+	mu           sync.Mutex // protects the fields below
+	fails        int        // consecutive dial failures
+	ejections    int        // consecutive ejections
+	ejectedUntil time.Time
+	down         bool // marked down by the health check
+}
+
+// available reports whether the upstream is neither down nor ejected at now. An upstream
+// whose ejection expired is available again, its next dial probes it.
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down && !now.Before(u.ejectedUntil)
+}
+
+// setDown marks the upstream down or up, it reports whether the mark changed.
+func (u *upstream) setDown(down bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := u.down != down
+	u.down = down
+	return changed
+}
+
+// dialed records the result of a dial. After maxFails consecutive failures, the upstream is
+// ejected for the backoff of its consecutive ejections, a failed probe ejects it again at once.
+func (u *upstream) dialed(err error, maxFails int, bs backoff.Strategy) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		u.fails, u.ejections = 0, 0
+		return
+	}
+	u.fails++
+	if maxFails > 0 && u.fails >= maxFails {
+		u.ejectedUntil = time.Now().Add(bs.Backoff(u.ejections))
+		u.ejections++
+	}
+}
+
+// pool balances the connections of a route across its upstreams.
+type pool struct {
+	strategy  string
+	upstreams []*upstream
+	next      atomic.Uint64 // round robin position
+	ring      []ringNode    // sorted by hash, for ConsistentHash
+}
+
+type ringNode struct {
+	hash uint32
+	u    *upstream
+}
+
+// newPool returns the pool of addrs, the upstreams of old with the same address are reused
+// so that their health and load survive a reload.
+func newPool(strategy string, addrs []string, old *pool) *pool {
+	reuse := make(map[string]*upstream)
+	if old != nil {
+		for _, u := range old.upstreams {
+			reuse[u.addr] = u
+		}
+	}
+	p := &pool{strategy: strategy}
+	for _, addr := range addrs {
+		u := reuse[addr]
+		if u == nil {
+			u = &upstream{addr: addr}
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	if strategy == ConsistentHash {
+		for _, u := range p.upstreams {
+			for i := 0; i < hashReplicas; i++ {
+				p.ring = append(p.ring, ringNode{hash: hash32(u.addr + "#" + strconv.Itoa(i)), u: u})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// pick returns the upstream for a connection from client, skipping the upstreams in tried.
+// The ejected upstreams are picked only if every other one has been tried.
+// It returns nil once every upstream has been tried.
+func (p *pool) pick(client net.Addr, tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	var candidates []*upstream
+	for _, u := range p.upstreams {
+		if !tried[u] && u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.strategy {
+	case LeastConn:
+		start := int(p.next.Add(1))
+		best := candidates[start%len(candidates)]
+		for i := range candidates {
+			u := candidates[(start+i)%len(candidates)]
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	case PowerOfTwo:
+		a := candidates[rand.Intn(len(candidates))]
+		b := candidates[rand.Intn(len(candidates))]
+		if b.active.Load() < a.active.Load() {
+			return b
+		}
+		return a
+	case ConsistentHash:
+		return p.lookup(client, candidates)
+	default:
+		return candidates[int(p.next.Add(1)-1)%len(candidates)]
+	}
+}
+
+// lookup returns the first candidate clockwise from the hash of the client IP on the ring.
+func (p *pool) lookup(client net.Addr, candidates []*upstream) *upstream {
+	ok := make(map[*upstream]bool, len(candidates))
+	for _, u := range candidates {
+		ok[u] = true
+	}
+	host := client.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	h := hash32(host)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for j := 0; j < len(p.ring); j++ {
+		if n := p.ring[(i+j)%len(p.ring)]; ok[n.u] {
+			return n.u
+		}
+	}
+	return candidates[0]
+}
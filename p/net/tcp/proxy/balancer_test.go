@@ -0,0 +1,147 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/tcp/proxy"
+)
+
+// startRoute applies a single route named "r" and returns its address.
+func startRoute(t *testing.T, f *Forwarder, r Route) net.Addr {
+	t.Helper()
+	r.Name, r.Listen = "r", "127.0.0.1:0"
+	if err := f.Apply(&Config{Routes: []Route{r}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	t.Cleanup(func() { f.Shutdown(context.Background()) })
+	return f.Addr("r")
+}
+
+// openGreeting dials addr and returns the open connection and the greeting of the server behind it.
+func openGreeting(t *testing.T, addr net.Addr) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return conn, string(b)
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	a, b, c := startServer(t, "a"), startServer(t, "b"), startServer(t, "c")
+	addr := startRoute(t, &Forwarder{}, Route{Upstreams: []string{a.Addr().String(), b.Addr().String(), c.Addr().String()}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		counts[greeting(t, addr)]++
+	}
+	for _, g := range []string{"a", "b", "c"} {
+		if counts[g] != 2 {
+			t.Errorf("upstreams reached %v, want each twice", counts)
+			break
+		}
+	}
+}
+
+func TestBalanceLeastConn(t *testing.T) {
+	a, b, c := startServer(t, "a"), startServer(t, "b"), startServer(t, "c")
+	addr := startRoute(t, &Forwarder{}, Route{Upstreams: []string{a.Addr().String(), b.Addr().String(), c.Addr().String()}, Balance: LeastConn})
+
+	// Every new connection goes to the upstream without connections.
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, g := openGreeting(t, addr)
+		defer conn.Close()
+		if seen[g] {
+			t.Fatalf("connection %d reached the loaded upstream %s", i, g)
+		}
+		seen[g] = true
+	}
+}
+
+func TestBalanceConsistentHash(t *testing.T) {
+	a, b, c := startServer(t, "a"), startServer(t, "b"), startServer(t, "c")
+	addr := startRoute(t, &Forwarder{}, Route{Upstreams: []string{a.Addr().String(), b.Addr().String(), c.Addr().String()}, Balance: ConsistentHash})
+
+	first := greeting(t, addr)
+	for i := 0; i < 5; i++ {
+		if g := greeting(t, addr); g != first {
+			t.Fatalf("client reached %s then %s", first, g)
+		}
+	}
+}
+
+func TestBalancePowerOfTwo(t *testing.T) {
+	a, b := startServer(t, "a"), startServer(t, "b")
+	addr := startRoute(t, &Forwarder{}, Route{Upstreams: []string{a.Addr().String(), b.Addr().String()}, Balance: PowerOfTwo})
+
+	for i := 0; i < 4; i++ {
+		if g := greeting(t, addr); g != "a" && g != "b" {
+			t.Fatalf("reached %q", g)
+		}
+	}
+}
+
+// countingDialer counts the dials per address.
+type countingDialer struct {
+	mu    sync.Mutex
+	dials map[string]int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials[address]++
+	d.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func (d *countingDialer) count(address string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[address]
+}
+
+type constantBackoff time.Duration
+
+func (b constantBackoff) Backoff(retries int) time.Duration {
+	return time.Duration(b)
+}
+
+func TestBalanceEjection(t *testing.T) {
+	a := startServer(t, "a")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	for _, tt := range []struct {
+		backoff   time.Duration
+		deadDials int
+	}{
+		{time.Hour, 2}, // ejected after MaxFails, not probed again
+		{0, 5},         // probed again at once
+	} {
+		d := &countingDialer{dials: make(map[string]int)}
+		f := &Forwarder{Dialer: d, Backoff: constantBackoff(tt.backoff)}
+		addr := startRoute(t, f, Route{Upstreams: []string{dead, a.Addr().String()}, MaxFails: 2})
+
+		for i := 0; i < 5; i++ {
+			if g := greeting(t, addr); g != "a" {
+				t.Fatalf("reached %q, want a", g)
+			}
+		}
+		if n := d.count(dead); n != tt.deadDials {
+			t.Errorf("backoff %v: dialed the dead upstream %d times, want %d", tt.backoff, n, tt.deadDials)
+		}
+		f.Shutdown(context.Background())
+	}
+}
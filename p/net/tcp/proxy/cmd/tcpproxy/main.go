@@ -0,0 +1,58 @@
+// Command tcpproxy forwards TCP connections according to a YAML or JSON configuration file,
+// see proxy.Config. The file is reloaded on SIGHUP, SIGINT and SIGTERM shut the proxy down
+// gracefully.
+//
+//	tcpproxy -config routes.yaml
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/tcp/proxy"
+)
+
+func main() {
+	configPath := flag.String("config", "tcpproxy.yaml", "configuration file, YAML or JSON")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "maximum duration for draining the connections on shutdown")
+	flag.Parse()
+
+	cfg, err := proxy.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f := &proxy.Forwarder{}
+	if err := f.Apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for sig := range sigc {
+		if sig != syscall.SIGHUP {
+			log.Printf("received %v, shutting down", sig)
+			break
+		}
+		cfg, err := proxy.LoadConfig(*configPath)
+		if err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		if err := f.Apply(cfg); err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		log.Printf("reloaded %s", *configPath)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if n, err := f.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v, %d connections cut", err, n)
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of a Forwarder.
+//
+// It is read from YAML or JSON, for instance:
+//
+//	dial_timeout: 5s
+//	routes:
+//	  - name: web
+//	    listen: ":8080"
+//	    upstream: "10.0.0.1:80"
+//	  - listen: "127.0.0.1:6380"
+//	    upstream: "redis.internal:6379"
+//	    dial_timeout: 1s
+//	  - name: api
+//	    listen: ":9000"
+//	    upstreams: ["10.0.0.2:9000", "10.0.0.3:9000"]
+//	    balance: least_conn
+//	    health_check:
+//	      type: http
+//	      path: /healthz
+//	      interval: 5s
+//	  - name: smtp
+//	    listen: ":25"
+//	    upstream: "10.0.0.4:25"
+//	    proxy_protocol_from: ["10.1.0.0/16"]
+//	    send_proxy_protocol: 2
+type Config struct {
+	// DialTimeout is the default timeout for connecting to the upstreams. Zero means no timeout.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+
+	Routes []Route `yaml:"routes"`
+}
+
+// Route forwards the connections accepted on a listen address to an upstream address.
+type Route struct {
+	// Name identifies the route across reloads, Listen if empty.
+	Name string `yaml:"name"`
+
+	// Listen is the TCP address to listen on.
+	Listen string `yaml:"listen"`
+
+	// Upstream is the TCP address to forward the connections to.
+	Upstream string `yaml:"upstream"`
+
+	// Upstreams are more addresses to balance the connections across, with Upstream.
+	Upstreams []string `yaml:"upstreams"`
+
+	// Balance is the balancing strategy across the upstreams: round_robin (the default),
+	// least_conn, p2c or hash.
+	Balance string `yaml:"balance"`
+
+	// MaxFails is the number of consecutive dial failures after which an upstream is ejected,
+	// 3 if zero. A negative value disables the ejection. An ejected upstream is probed again
+	// after an exponential backoff.
+	MaxFails int `yaml:"max_fails"`
+
+	// HealthCheck, if not nil, actively checks the upstreams.
+	HealthCheck *HealthCheck `yaml:"health_check"`
+
+	// ProxyProtocolFrom are the CIDR ranges and IP addresses of the trusted sources, such as
+	// load balancers, whose connections start with a PROXY protocol header (version 1 or 2).
+	// The addresses in the header replace the addresses of these connections. The connections
+	// from the other sources are not expected to send a header.
+	ProxyProtocolFrom []string `yaml:"proxy_protocol_from"`
+
+	// SendProxyProtocol is the version of the PROXY protocol header sent to the upstreams
+	// with the addresses of the client, 1 or 2. Zero sends no header.
+	SendProxyProtocol int `yaml:"send_proxy_protocol"`
+
+	// DialTimeout overrides Config.DialTimeout for the route.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+}
+
+// LoadConfig reads the configuration file at path, in YAML or JSON.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// ParseConfig parses a configuration in YAML or JSON, JSON being a subset of YAML,
+// and validates it.
+func ParseConfig(b []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("proxy: parse config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that every route has a listen address, an upstream and a unique name.
+func (cfg *Config) Validate() error {
+	names := make(map[string]bool)
+	for i, r := range cfg.Routes {
+		if r.Listen == "" {
+			return fmt.Errorf("proxy: route %d: missing listen address", i)
+		}
+		if len(r.upstreams()) == 0 {
+			return fmt.Errorf("proxy: route %d: missing upstream", i)
+		}
+		switch r.Balance {
+		case "", RoundRobin, LeastConn, PowerOfTwo, ConsistentHash:
+		default:
+			return fmt.Errorf("proxy: route %d: unknown balancing strategy %q", i, r.Balance)
+		}
+		if r.HealthCheck != nil {
+			if err := r.HealthCheck.validate(); err != nil {
+				return fmt.Errorf("proxy: route %d: %w", i, err)
+			}
+		}
+		if _, err := parseNets(r.ProxyProtocolFrom); err != nil {
+			return fmt.Errorf("proxy: route %d: proxy_protocol_from: %w", i, err)
+		}
+		if r.SendProxyProtocol < 0 || r.SendProxyProtocol > 2 {
+			return fmt.Errorf("proxy: route %d: unknown PROXY protocol version %d", i, r.SendProxyProtocol)
+		}
+		name := r.name()
+		if names[name] {
+			return fmt.Errorf("proxy: route %d: duplicate name %q", i, name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+func (r Route) upstreams() []string {
+	var addrs []string
+	if r.Upstream != "" {
+		addrs = append(addrs, r.Upstream)
+	}
+	return append(addrs, r.Upstreams...)
+}
+
+func (r Route) maxFails() int {
+	if r.MaxFails == 0 {
+		return defaultMaxFails
+	}
+	return r.MaxFails
+}
+
+func (r Route) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Listen
+}
+
+// parseNets parses CIDR ranges and IP addresses.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if strings.Contains(s, "/") {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
@@ -0,0 +1,380 @@
+// Package proxy forwards TCP connections: each route listens on an address and forwards
+// the accepted connections to an upstream address.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/proxyproto"
+	"github.com/gptlocal/netool/w/grpc/backoff"
+)
+
+var ErrForwarderClosed = errors.New("proxy: forwarder closed")
+
+// shutdownPollIntervalMax is the maximum interval between two checks of the connections
+// during Shutdown.
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// proxyHeaderTimeout is the time a trusted source has to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// Dialer connects to the upstreams, net.Dialer satisfies this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Forwarder runs the routes of a Config. Apply starts the routes and reconfigures them
+// on reload, Shutdown stops them.
+type Forwarder struct {
+	// Dialer connects to the upstreams. If nil, a zero net.Dialer is used.
+	Dialer Dialer
+
+	// Backoff is the delay before probing an upstream ejected after dial failures, given its
+	// number of consecutive ejections. If nil, backoff.DefaultExponential is used.
+	Backoff backoff.Strategy
+
+	mu         sync.Mutex // protects the fields below
+	routes     map[string]*route
+	conns      map[net.Conn]struct{}
+	inShutdown bool
+}
+
+// route is a running route.
+type route struct {
+	ln net.Listener
+
+	mu         sync.Mutex // protects the fields below
+	cfg        Route      // with the default dial timeout applied
+	pool       *pool
+	trusted    []*net.IPNet       // sources sending a PROXY protocol header
+	stopChecks context.CancelFunc // stops the health checks of the pool, if any
+}
+
+// setConfig makes rc the configuration of the route and starts the health checks of its
+// upstreams, d connects to the upstreams.
+func (r *route) setConfig(rc Route, d Dialer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopChecks != nil {
+		r.stopChecks()
+		r.stopChecks = nil
+	}
+	r.cfg = rc
+	r.pool = newPool(rc.Balance, rc.upstreams(), r.pool)
+	r.trusted, _ = parseNets(rc.ProxyProtocolFrom)
+
+	if rc.HealthCheck == nil {
+		for _, u := range r.pool.upstreams {
+			u.setDown(false)
+		}
+		return
+	}
+	var ctx context.Context
+	ctx, r.stopChecks = context.WithCancel(context.Background())
+	hc := *rc.HealthCheck
+	for _, u := range r.pool.upstreams {
+		go hc.run(ctx, d, u)
+	}
+}
+
+// stop stops listening and checking the upstreams.
+func (r *route) stop() {
+	r.ln.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopChecks != nil {
+		r.stopChecks()
+		r.stopChecks = nil
+	}
+}
+
+func (r *route) config() Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// trusts reports whether the connections from addr start with a PROXY protocol header.
+func (r *route) trusts(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, n := range r.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) snapshot() (Route, *pool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg, r.pool
+}
+
+// Apply makes the routes of cfg the routes of the forwarder: the new routes start listening,
+// the removed ones stop listening and the others forward their next connections to their
+// new upstream. A route whose listen address changed is restarted. The connections in
+// progress are not interrupted.
+//
+// Apply keeps going when a route fails to listen, it returns the first error.
+func (f *Forwarder) Apply(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.inShutdown {
+		return ErrForwarderClosed
+	}
+	if f.routes == nil {
+		f.routes = make(map[string]*route)
+	}
+
+	wanted := make(map[string]bool)
+	var firstErr error
+	for _, rc := range cfg.Routes {
+		if rc.DialTimeout == 0 {
+			rc.DialTimeout = cfg.DialTimeout
+		}
+		name := rc.name()
+		wanted[name] = true
+
+		if r, ok := f.routes[name]; ok {
+			if r.config().Listen == rc.Listen {
+				r.setConfig(rc, f.dialer())
+				continue
+			}
+			r.stop()
+			delete(f.routes, name)
+		}
+
+		ln, err := net.Listen("tcp", rc.Listen)
+		if err != nil {
+			log.Printf("proxy: route %s: %v", name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		r := &route{ln: ln}
+		r.setConfig(rc, f.dialer())
+		f.routes[name] = r
+		log.Printf("proxy: route %s: listening on %s, forwarding to %s", name, ln.Addr(), strings.Join(rc.upstreams(), ", "))
+		go f.serve(r)
+	}
+
+	for name, r := range f.routes {
+		if !wanted[name] {
+			log.Printf("proxy: route %s: removed", name)
+			r.stop()
+			delete(f.routes, name)
+		}
+	}
+	return firstErr
+}
+
+// Addr returns the listen address of the named route, or nil if the route is not running.
+func (f *Forwarder) Addr(name string) net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r, ok := f.routes[name]; ok {
+		return r.ln.Addr()
+	}
+	return nil
+}
+
+func (f *Forwarder) serve(r *route) {
+	var tempDelay time.Duration
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("proxy: accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("proxy: route %s: accept: %v", r.config().name(), err)
+			}
+			return
+		}
+		tempDelay = 0
+
+		if !f.trackConn(conn, true) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer f.trackConn(conn, false)
+			defer conn.Close()
+			f.forward(conn, r)
+		}()
+	}
+}
+
+// forward forwards conn to an upstream of r, the next upstream is tried if the dial fails.
+func (f *Forwarder) forward(conn net.Conn, r *route) {
+	rc, p := r.snapshot()
+	src, dst := conn.RemoteAddr(), conn.LocalAddr()
+	var tlvs []proxyproto.TLV
+	if r.trusts(src) {
+		h, err := readProxyHeader(conn)
+		if err != nil {
+			log.Printf("proxy: %s: read PROXY protocol header: %v", src, err)
+			return
+		}
+		if h.Command == proxyproto.Proxy && h.Source != nil {
+			src, dst = h.Source, h.Destination
+		}
+		tlvs = h.TLVs
+	}
+
+	tried := make(map[*upstream]bool)
+	for {
+		u := p.pick(src, tried)
+		if u == nil {
+			log.Printf("proxy: %s: route %s: no upstream available", src, rc.name())
+			return
+		}
+		tried[u] = true
+
+		cc, err := f.dial(rc, u.addr)
+		u.dialed(err, rc.maxFails(), f.backoff())
+		if err != nil {
+			log.Printf("proxy: %s: dial %s: %v", src, u.addr, err)
+			continue
+		}
+		defer cc.Close()
+
+		if rc.SendProxyProtocol != 0 {
+			h := &proxyproto.Header{Version: rc.SendProxyProtocol, Command: proxyproto.Proxy, Source: src, Destination: dst, TLVs: tlvs}
+			if _, err := h.WriteTo(cc); err != nil {
+				log.Printf("proxy: %s: write PROXY protocol header to %s: %v", src, u.addr, err)
+				return
+			}
+		}
+
+		u.active.Add(1)
+		defer u.active.Add(-1)
+		if err := transport(conn, cc); err != nil {
+			log.Printf("proxy: %s <-> %s: %v", src, u.addr, err)
+		}
+		return
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header starting conn, the rest of conn is the payload.
+func readProxyHeader(conn net.Conn) (*proxyproto.Header, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return proxyproto.ReadHeader(conn)
+}
+
+func (f *Forwarder) dial(rc Route, address string) (net.Conn, error) {
+	ctx := context.Background()
+	if rc.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.DialTimeout)
+		defer cancel()
+	}
+	return f.dialer().DialContext(ctx, "tcp", address)
+}
+
+func (f *Forwarder) backoff() backoff.Strategy {
+	if f.Backoff != nil {
+		return f.Backoff
+	}
+	return backoff.DefaultExponential
+}
+
+func (f *Forwarder) dialer() Dialer {
+	if f.Dialer != nil {
+		return f.Dialer
+	}
+	return &net.Dialer{}
+}
+
+// trackConn adds or removes conn from the connections drained by Shutdown,
+// it reports false if the forwarder is shutting down.
+func (f *Forwarder) trackConn(conn net.Conn, add bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !add {
+		delete(f.conns, conn)
+		return true
+	}
+	if f.inShutdown {
+		return false
+	}
+	if f.conns == nil {
+		f.conns = make(map[net.Conn]struct{})
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+// Shutdown stops listening on every route and waits for the connections in progress to finish.
+// If ctx expires first, the remaining connections are closed and Shutdown returns their number
+// with the context's error.
+func (f *Forwarder) Shutdown(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	f.inShutdown = true
+	for name, r := range f.routes {
+		r.stop()
+		delete(f.routes, name)
+	}
+	f.mu.Unlock()
+
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		f.mu.Lock()
+		n := len(f.conns)
+		f.mu.Unlock()
+		if n == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return f.closeConns(), ctx.Err()
+		case <-timer.C:
+			if interval *= 2; interval > shutdownPollIntervalMax {
+				interval = shutdownPollIntervalMax
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// closeConns closes the connections in progress and returns their number.
+func (f *Forwarder) closeConns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.conns)
+	for conn := range f.conns {
+		conn.Close()
+		delete(f.conns, conn)
+	}
+	return n
+}
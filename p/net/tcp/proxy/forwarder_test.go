@@ -0,0 +1,160 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/tcp/proxy"
+)
+
+// startServer serves a TCP server writing greeting to every connection, then echoing.
+func startServer(t *testing.T, greeting string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, greeting)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// greeting dials addr and returns the greeting of the server behind it.
+func greeting(t *testing.T, addr net.Addr) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+func TestForwarderApply(t *testing.T) {
+	a := startServer(t, "a")
+	b := startServer(t, "b")
+
+	f := &Forwarder{}
+	defer f.Shutdown(context.Background())
+	err := f.Apply(&Config{Routes: []Route{
+		{Name: "one", Listen: "127.0.0.1:0", Upstream: a.Addr().String()},
+		{Name: "two", Listen: "127.0.0.1:0", Upstream: b.Addr().String()},
+	}})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	one, two := f.Addr("one"), f.Addr("two")
+	if got := greeting(t, one); got != "a" {
+		t.Errorf("route one reached %q, want a", got)
+	}
+	if got := greeting(t, two); got != "b" {
+		t.Errorf("route two reached %q, want b", got)
+	}
+
+	// Reload: route one moves to b, route two is removed.
+	if err := f.Apply(&Config{Routes: []Route{
+		{Name: "one", Listen: "127.0.0.1:0", Upstream: b.Addr().String()},
+	}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if f.Addr("one").String() != one.String() {
+		t.Errorf("route one restarted on %v, was %v", f.Addr("one"), one)
+	}
+	if got := greeting(t, one); got != "b" {
+		t.Errorf("reloaded route one reached %q, want b", got)
+	}
+	if f.Addr("two") != nil {
+		t.Error("route two still running")
+	}
+	if conn, err := net.Dial("tcp", two.String()); err == nil {
+		conn.Close()
+		t.Error("route two still listening")
+	}
+}
+
+func TestForwarderShutdown(t *testing.T) {
+	a := startServer(t, "a")
+	f := &Forwarder{}
+	if err := f.Apply(&Config{Routes: []Route{{Listen: "127.0.0.1:0", Upstream: a.Addr().String()}}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", f.Addr("127.0.0.1:0").String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	io.ReadFull(conn, make([]byte, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n, err := f.Shutdown(ctx)
+	if n != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %d, %v, want 1, %v", n, err, context.DeadlineExceeded)
+	}
+	if err := f.Apply(&Config{}); err != ErrForwarderClosed {
+		t.Errorf("Apply after Shutdown = %v, want %v", err, ErrForwarderClosed)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"routes.yaml": "dial_timeout: 5s\nroutes:\n  - name: web\n    listen: \":8080\"\n    upstream: 10.0.0.1:80\n    dial_timeout: 1s\n",
+		"routes.json": `{"dial_timeout": "5s", "routes": [{"name": "web", "listen": ":8080", "upstream": "10.0.0.1:80", "dial_timeout": "1s"}]}`,
+	}
+	want := Route{Name: "web", Listen: ":8080", Upstream: "10.0.0.1:80", DialTimeout: time.Second}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cfg.DialTimeout != 5*time.Second || len(cfg.Routes) != 1 || !reflect.DeepEqual(cfg.Routes[0], want) {
+			t.Errorf("%s: got %+v, want one route %+v", name, cfg, want)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, s := range []string{
+		"routes: [",
+		"routes:\n  - upstream: a:1\n",
+		"routes:\n  - listen: :1\n",
+		"routes:\n  - listen: :1\n    upstream: a:1\n    balance: random\n",
+		"routes:\n  - listen: :1\n    upstream: a:1\n  - listen: :1\n    upstream: b:1\n",
+		"dial_timeout: soon\n",
+		"routes:\n  - listen: :1\n    upstream: a:1\n    proxy_protocol_from: [10.0.0.0/33]\n",
+		"routes:\n  - listen: :1\n    upstream: a:1\n    send_proxy_protocol: 3\n",
+	} {
+		if _, err := ParseConfig([]byte(s)); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "github.com/gptlocal/netool/w/grpc/health/grpc_health_v1"
+)
+
+// Health check types of HealthCheck.Type.
+const (
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+	CheckGRPC = "grpc"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	defaultRise          = 2
+	defaultFall          = 3
+)
+
+// HealthCheck actively checks the upstreams of a route. An upstream is marked down after Fall
+// consecutive failed checks and up again after Rise consecutive successful ones, the upstreams
+// marked down are skipped by the balancing unless every upstream is unavailable.
+// The upstreams are up until checked otherwise.
+type HealthCheck struct {
+	// Type is the check: tcp connects to the upstream (the default), http sends a GET request
+	// for Path and expects Status, grpc calls the Check method of the grpc.health.v1 service
+	// for Service and expects SERVING.
+	Type string `yaml:"type"`
+
+	// Interval is the interval between two checks, 10s if zero.
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout is the maximum duration of a check, 2s if zero.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Rise and Fall are the thresholds of consecutive results, 2 and 3 if zero.
+	Rise int `yaml:"rise"`
+	Fall int `yaml:"fall"`
+
+	// Path is the request path of the http check, "/" if empty.
+	Path string `yaml:"path"`
+
+	// Status is the expected response status of the http check, 200 if zero.
+	Status int `yaml:"status"`
+
+	// Service is the service name of the grpc check, the empty name is the whole server.
+	Service string `yaml:"service"`
+}
+
+func (hc *HealthCheck) validate() error {
+	switch hc.Type {
+	case "", CheckTCP, CheckHTTP, CheckGRPC:
+		return nil
+	default:
+		return fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+}
+
+// Check checks the upstream at addr once, d connects to it.
+func (hc *HealthCheck) Check(ctx context.Context, d Dialer, addr string) error {
+	switch hc.Type {
+	case CheckHTTP:
+		return hc.checkHTTP(ctx, d, addr)
+	case CheckGRPC:
+		return hc.checkGRPC(ctx, d, addr)
+	default:
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func (hc *HealthCheck) checkHTTP(ctx context.Context, d Dialer, addr string) error {
+	path := hc.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{DialContext: d.DialContext, DisableKeepAlives: true}
+	defer tr.CloseIdleConnections()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	want := hc.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("status %s, want %d", resp.Status, want)
+	}
+	return nil
+}
+
+func (hc *HealthCheck) checkGRPC(ctx context.Context, d Dialer, addr string) error {
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := pb.NewHealthClient(conn).Check(ctx, &pb.HealthCheckRequest{Service: hc.Service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != pb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("serving status %v", resp.Status)
+	}
+	return nil
+}
+
+// run checks u every interval until ctx is done, and marks it up or down.
+func (hc *HealthCheck) run(ctx context.Context, d Dialer, u *upstream) {
+	interval, timeout := hc.Interval, hc.Timeout
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	rise, fall := hc.Rise, hc.Fall
+	if rise <= 0 {
+		rise = defaultRise
+	}
+	if fall <= 0 {
+		fall = defaultFall
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var successes, failures int
+	for {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		err := hc.Check(cctx, d, u.addr)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes, failures = successes+1, 0
+			if successes == rise && u.setDown(false) {
+				log.Printf("proxy: upstream %s is up", u.addr)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if failures == fall && u.setDown(true) {
+				log.Printf("proxy: upstream %s is down: %v", u.addr, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
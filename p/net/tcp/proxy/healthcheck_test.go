@@ -0,0 +1,126 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	. "github.com/gptlocal/netool/p/net/tcp/proxy"
+	"github.com/gptlocal/netool/w/grpc/health"
+	pb "github.com/gptlocal/netool/w/grpc/health/grpc_health_v1"
+	"github.com/gptlocal/netool/w/net/http/httptest"
+)
+
+func TestHealthCheckCheck(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	tcp := startServer(t, "a")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	gln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("down", pb.HealthCheckResponse_NOT_SERVING)
+	gs := grpc.NewServer()
+	pb.RegisterHealthServer(gs, hs)
+	go gs.Serve(gln)
+	defer gs.Stop()
+
+	tests := []struct {
+		hc   HealthCheck
+		addr string
+		ok   bool
+	}{
+		{HealthCheck{}, tcp.Addr().String(), true},
+		{HealthCheck{Type: CheckTCP}, closed, false},
+		{HealthCheck{Type: CheckHTTP, Path: "/healthz"}, ts.Listener.Addr().String(), true},
+		{HealthCheck{Type: CheckHTTP}, ts.Listener.Addr().String(), false},
+		{HealthCheck{Type: CheckHTTP, Status: http.StatusServiceUnavailable}, ts.Listener.Addr().String(), true},
+		{HealthCheck{Type: CheckHTTP}, tcp.Addr().String(), false},
+		{HealthCheck{Type: CheckGRPC}, gln.Addr().String(), true},
+		{HealthCheck{Type: CheckGRPC, Service: "down"}, gln.Addr().String(), false},
+		{HealthCheck{Type: CheckGRPC, Service: "unknown"}, gln.Addr().String(), false},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := tt.hc.Check(ctx, &net.Dialer{}, tt.addr)
+		cancel()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: Check(%s) = %v, want ok %v", tt.hc, tt.addr, err, tt.ok)
+		}
+	}
+}
+
+func TestHealthCheckMarksUpstreams(t *testing.T) {
+	newUpstream := func(name string, healthy *atomic.Bool) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	var aHealthy, bHealthy atomic.Bool
+	aHealthy.Store(true)
+	a, b := newUpstream("a", &aHealthy), newUpstream("b", &bHealthy)
+
+	addr := startRoute(t, &Forwarder{}, Route{
+		Upstreams: []string{a.Listener.Addr().String(), b.Listener.Addr().String()},
+		HealthCheck: &HealthCheck{
+			Type:     CheckHTTP,
+			Path:     "/healthz",
+			Interval: 10 * time.Millisecond,
+			Rise:     1,
+			Fall:     1,
+		},
+	})
+
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() string {
+		resp, err := c.Get("http://" + addr.String() + "/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	// waitFor waits until the consecutive responses of 4 requests are want.
+	waitFor := func(want func(string) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for n := 0; n < 4; {
+			if want(get()) {
+				n++
+			} else {
+				n = 0
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the health checks")
+			}
+		}
+	}
+
+	waitFor(func(s string) bool { return s == "a" })
+
+	bHealthy.Store(true)
+	seen := make(map[string]bool)
+	waitFor(func(s string) bool { seen[s] = true; return seen["a"] && seen["b"] })
+}
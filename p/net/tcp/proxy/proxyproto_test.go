@@ -0,0 +1,169 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gptlocal/netool/p/net/proxyproto"
+	. "github.com/gptlocal/netool/p/net/tcp/proxy"
+)
+
+// startHeaderServer serves a TCP server reading a PROXY protocol header from every connection,
+// then echoing. The headers are sent on the returned channel.
+func startHeaderServer(t *testing.T) (net.Listener, <-chan *proxyproto.Header) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	headers := make(chan *proxyproto.Header, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				h, err := proxyproto.ReadHeader(conn)
+				if err != nil {
+					t.Errorf("ReadHeader: %v", err)
+					return
+				}
+				headers <- h
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln, headers
+}
+
+// echo writes msg to conn and checks that it is echoed.
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b) != msg {
+		t.Errorf("echo = %q, want %q", b, msg)
+	}
+}
+
+func TestProxyProtocolRelay(t *testing.T) {
+	ln, headers := startHeaderServer(t)
+	addr := startRoute(t, &Forwarder{}, Route{
+		Upstream:          ln.Addr().String(),
+		ProxyProtocolFrom: []string{"127.0.0.0/8"},
+		SendProxyProtocol: 2,
+	})
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	in := &proxyproto.Header{
+		Version:     1,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+		Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+	}
+	if _, err := in.WriteTo(conn); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	echo(t, conn, "hello")
+
+	h := <-headers
+	if h.Version != 2 || h.Command != proxyproto.Proxy {
+		t.Errorf("upstream header version %d command %d, want 2 and PROXY", h.Version, h.Command)
+	}
+	if h.Source.String() != "203.0.113.7:40000" || h.Destination.String() != "198.51.100.1:443" {
+		t.Errorf("upstream header addresses %s -> %s, want the client's", h.Source, h.Destination)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	ln, headers := startHeaderServer(t)
+	addr := startRoute(t, &Forwarder{}, Route{
+		Upstream:          ln.Addr().String(),
+		ProxyProtocolFrom: []string{"192.0.2.1"},
+		SendProxyProtocol: 1,
+	})
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The header of an untrusted source is forwarded as payload.
+	spoofed := "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n"
+	echo(t, conn, spoofed)
+
+	h := <-headers
+	if h.Source.String() != conn.LocalAddr().String() || h.Destination.String() != addr.String() {
+		t.Errorf("upstream header addresses %s -> %s, want %s -> %s", h.Source, h.Destination, conn.LocalAddr(), addr)
+	}
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	a := startServer(t, "a")
+	addr := startRoute(t, &Forwarder{}, Route{
+		Upstream:          a.Addr().String(),
+		ProxyProtocolFrom: []string{"127.0.0.1", "::1"},
+	})
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, _ := io.ReadAll(conn); len(b) != 0 {
+		t.Errorf("read %q, want the connection closed before reaching the upstream", b)
+	}
+}
+
+func TestProxyProtocolV2TLVs(t *testing.T) {
+	ln, headers := startHeaderServer(t)
+	addr := startRoute(t, &Forwarder{}, Route{
+		Upstream:          ln.Addr().String(),
+		ProxyProtocolFrom: []string{"127.0.0.0/8"},
+		SendProxyProtocol: 2,
+	})
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	in := &proxyproto.Header{
+		Version:     2,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		TLVs:        []proxyproto.TLV{{Type: 0x02, Value: []byte("example.com")}},
+	}
+	if _, err := in.WriteTo(conn); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	echo(t, conn, "hello")
+
+	h := <-headers
+	if h.Source.String() != "[2001:db8::1]:1234" {
+		t.Errorf("upstream header source %s, want [2001:db8::1]:1234", h.Source)
+	}
+	if len(h.TLVs) != 1 || h.TLVs[0].Type != 0x02 || !bytes.Equal(h.TLVs[0].Value, []byte("example.com")) {
+		t.Errorf("upstream header TLVs %v, want the client's", h.TLVs)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+var (
+	tinyBufferSize   = 512
+	smallBufferSize  = 2 * 1024  // 2KB small buffer
+	mediumBufferSize = 8 * 1024  // 8KB medium buffer
+	largeBufferSize  = 32 * 1024 // 32KB large buffer
+)
+
+var (
+	sPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, smallBufferSize)
+		},
+	}
+	mPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, mediumBufferSize)
+		},
+	}
+	lPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, largeBufferSize)
+		},
+	}
+)
+
+func transport(rw1, rw2 io.ReadWriter) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- copyBuffer(rw1, rw2)
+	}()
+
+	go func() {
+		errc <- copyBuffer(rw2, rw1)
+	}()
+
+	if err := <-errc; err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// copyBuffer copies from src to dst with a pooled buffer. Between two *net.TCPConn on Linux,
+// io.CopyBuffer does not use the buffer: (*net.TCPConn).WriteTo hands the copy to
+// (*net.TCPConn).ReadFrom, which moves the data with splice(2).
+func copyBuffer(dst io.Writer, src io.Reader) error {
+	buf := lPool.Get().([]byte)
+	defer lPool.Put(buf)
+
+	_, err := io.CopyBuffer(dst, src, buf)
+	return err
+}
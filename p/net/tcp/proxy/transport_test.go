@@ -0,0 +1,87 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gptlocal/netool/p/net/tcp/proxy"
+)
+
+// wrappingDialer hides the type of the upstream connections, so that the transport copies
+// through the pooled buffer instead of splicing.
+type wrappingDialer struct{}
+
+func (wrappingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ net.Conn }{conn}, nil
+}
+
+// benchmarkTransport echoes b.N chunks of 64KB through a route to an echo server.
+func benchmarkTransport(b *testing.B, f *Forwarder) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	if err := f.Apply(&Config{Routes: []Route{{Name: "r", Listen: "127.0.0.1:0", Upstream: ln.Addr().String()}}}); err != nil {
+		b.Fatalf("Apply: %v", err)
+	}
+	defer f.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", f.Addr("r").String())
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	if _, err := io.CopyN(io.Discard, conn, int64(b.N*len(chunk))); err != nil {
+		b.Fatalf("read: %v", err)
+	}
+	if err := <-errc; err != nil {
+		b.Fatalf("write: %v", err)
+	}
+}
+
+// BenchmarkTransportSplice copies between TCP connections, the standard library splices them
+// on Linux.
+func BenchmarkTransportSplice(b *testing.B) {
+	benchmarkTransport(b, &Forwarder{})
+}
+
+// BenchmarkTransportBuffer copies through pooled buffers.
+func BenchmarkTransportBuffer(b *testing.B) {
+	benchmarkTransport(b, &Forwarder{Dialer: wrappingDialer{}})
+}
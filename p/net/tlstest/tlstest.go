@@ -0,0 +1,121 @@
+// Package tlstest generates self-signed certificate authorities and the certificates
+// they issue, for use in tests.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// CA is a self-signed certificate authority.
+type CA struct {
+	Cert *x509.Certificate
+
+	key *ecdsa.PrivateKey
+}
+
+// NewCA returns a new self-signed certificate authority named name.
+func NewCA(tb testing.TB, name string) *CA {
+	tb.Helper()
+
+	key := newKey(tb)
+	tmpl := template(tb, name)
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatalf("tlstest: create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("tlstest: parse CA certificate: %v", err)
+	}
+	return &CA{Cert: cert, key: key}
+}
+
+// Pool returns a certificate pool holding the CA certificate, for use as RootCAs or ClientCAs.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// ServerCert issues a server certificate valid for hosts, which are IP addresses or DNS names.
+func (ca *CA) ServerCert(tb testing.TB, hosts ...string) tls.Certificate {
+	tb.Helper()
+
+	tmpl := template(tb, "server")
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return ca.issue(tb, tmpl)
+}
+
+// ClientCert issues a client certificate with the subject common name cn.
+func (ca *CA) ClientCert(tb testing.TB, cn string) tls.Certificate {
+	tb.Helper()
+
+	tmpl := template(tb, cn)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(tb, tmpl)
+}
+
+func (ca *CA) issue(tb testing.TB, tmpl *x509.Certificate) tls.Certificate {
+	tb.Helper()
+
+	key := newKey(tb)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		tb.Fatalf("tlstest: create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("tlstest: parse certificate: %v", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func newKey(tb testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatalf("tlstest: generate key: %v", err)
+	}
+	return key
+}
+
+func template(tb testing.TB, cn string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		tb.Fatalf("tlstest: generate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+	}
+}
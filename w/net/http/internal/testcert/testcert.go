@@ -0,0 +1,30 @@
+// Package testcert contains a test-only localhost certificate.
+package testcert
+
+import "strings"
+
+// LocalhostCert is a PEM-encoded TLS cert with SAN IPs
+// "127.0.0.1" and "[::1]", expiring at Jan 29 16:00:00 2084 GMT.
+var LocalhostCert = []byte(`-----BEGIN CERTIFICATE-----
+MIIBrTCCAVOgAwIBAgIBATAKBggqhkjOPQQDAjASMRAwDgYDVQQKEwdBY21lIENv
+MCAXDTcwMDEwMTAwMDAwMFoYDzIwODQwMTI5MTYwMDAwWjASMRAwDgYDVQQKEwdB
+Y21lIENvMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEZ232VdpaHLMmdDfBLGkM
+J9W9J4ZeKaX2zf5gMpyC5t144RF4hTytOnKI/xqbdw2Pguvcw1Vk+BwyNGPdvu8q
+laOBlzCBlDAOBgNVHQ8BAf8EBAMCAoQwEwYDVR0lBAwwCgYIKwYBBQUHAwEwDwYD
+VR0TAQH/BAUwAwEB/zAdBgNVHQ4EFgQU5IUTNz7G+AMaA8P9CNc0jx4vgdYwPQYD
+VR0RBDYwNIILZXhhbXBsZS5jb22CDSouZXhhbXBsZS5jb22HBH8AAAGHEAAAAAAA
+AAAAAAAAAAAAAAEwCgYIKoZIzj0EAwIDSAAwRQIgE+axmKjSYYZlW4BZJoeQNLCO
+1+ZoB9PbmO3bkIlAJBICIQCa0uVW0AjOWbFoqJ9oZ5+eNN+PFCxih/7XzHgUHRdl
+pw==
+-----END CERTIFICATE-----
+`)
+
+// LocalhostKey is the private key for LocalhostCert.
+var LocalhostKey = []byte(testingKey(`-----BEGIN TESTING KEY-----
+MIGHAgEAMBMGByqGSM49AgEGCCqGSM49AwEHBG0wawIBAQQgEPEetNkmpeGHCNOd
+SgdFT/FTbu1qnEhqaubmtFDH0EOhRANCAARnbfZV2locsyZ0N8EsaQwn1b0nhl4p
+pfbN/mAynILm3XjhEXiFPK06coj/Gpt3DY+C69zDVWT4HDI0Y92+7yqV
+-----END TESTING KEY-----
+`))
+
+func testingKey(s string) string { return strings.ReplaceAll(s, "TESTING KEY", "PRIVATE KEY") }